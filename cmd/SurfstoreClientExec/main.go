@@ -8,17 +8,57 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Arguments
 const ARG_COUNT int = 3
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d -n -preserve -rehash -j parallelism -ignore patterns -snapshot name -snapshots -checkout name -usage -list -prefix prefix -tls -ca file host:port baseDir blockSize"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
 
+const DRYRUN_NAME = "n"
+const DRYRUN_USAGE = "Print the planned action of each file without syncing"
+
+const PRESERVE_NAME = "preserve"
+const PRESERVE_USAGE = "Preserve mode bits, modification times and symlinks of synced files"
+
+const REHASH_NAME = "rehash"
+const REHASH_USAGE = "Hash every file instead of skipping files whose size, mtime and inode are unchanged"
+
+const PARALLELISM_NAME = "j"
+const PARALLELISM_USAGE = "Number of blocks transferred at once"
+
+const IGNORE_NAME = "ignore"
+const IGNORE_USAGE = "Comma separated gitignore-style patterns ignored in addition to the base dir's .surfignore"
+
+const SNAPSHOT_NAME = "snapshot"
+const SNAPSHOT_USAGE = "Create a snapshot of the server's files with this name instead of syncing"
+
+const SNAPSHOTS_NAME = "snapshots"
+const SNAPSHOTS_USAGE = "List the server's snapshots instead of syncing"
+
+const CHECKOUT_NAME = "checkout"
+const CHECKOUT_USAGE = "Write the files of the named snapshot into baseDir instead of syncing"
+
+const USAGE_NAME = "usage"
+const USAGE_USAGE = "Print the server's usage and quotas instead of syncing"
+
+const LIST_NAME = "list"
+const LIST_USAGE = "List the server's files, page by page, instead of syncing"
+
+const PREFIX_NAME = "prefix"
+const PREFIX_USAGE = "Only list files whose names start with this prefix"
+
+const TLS_NAME = "tls"
+const TLS_USAGE = "Connect to the servers over TLS, verifying their certificates against the system's roots"
+
+const CA_NAME = "ca"
+const CA_USAGE = "PEM file of the CA certificates the servers' certificates are verified against, implies -tls"
+
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
 
@@ -30,6 +70,7 @@ const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
 // Exit codes
 const EX_USAGE int = 64
+const EX_UNAVAILABLE int = 69
 
 func main() {
 	// Custom flag Usage message
@@ -37,13 +78,39 @@ func main() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DRYRUN_NAME, DRYRUN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PRESERVE_NAME, PRESERVE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REHASH_NAME, REHASH_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PARALLELISM_NAME, PARALLELISM_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", IGNORE_NAME, IGNORE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SNAPSHOT_NAME, SNAPSHOT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SNAPSHOTS_NAME, SNAPSHOTS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CHECKOUT_NAME, CHECKOUT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", USAGE_NAME, USAGE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", LIST_NAME, LIST_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PREFIX_NAME, PREFIX_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_NAME, TLS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CA_NAME, CA_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
 	}
 
 	// Parse command-line arguments and flags
-	debug := flag.Bool("d", false, DEBUG_USAGE)
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	dryRun := flag.Bool(DRYRUN_NAME, false, DRYRUN_USAGE)
+	preserve := flag.Bool(PRESERVE_NAME, false, PRESERVE_USAGE)
+	rehash := flag.Bool(REHASH_NAME, false, REHASH_USAGE)
+	parallelism := flag.Int(PARALLELISM_NAME, surfstore.DEFAULT_PARALLELISM, PARALLELISM_USAGE)
+	ignorePatterns := flag.String(IGNORE_NAME, "", IGNORE_USAGE)
+	snapshot := flag.String(SNAPSHOT_NAME, "", SNAPSHOT_USAGE)
+	listSnapshots := flag.Bool(SNAPSHOTS_NAME, false, SNAPSHOTS_USAGE)
+	checkout := flag.String(CHECKOUT_NAME, "", CHECKOUT_USAGE)
+	showUsage := flag.Bool(USAGE_NAME, false, USAGE_USAGE)
+	listFiles := flag.Bool(LIST_NAME, false, LIST_USAGE)
+	prefix := flag.String(PREFIX_NAME, "", PREFIX_USAGE)
+	useTLS := flag.Bool(TLS_NAME, false, TLS_USAGE)
+	caFile := flag.String(CA_NAME, "", CA_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
@@ -69,5 +136,62 @@ func main() {
 	}
 
 	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+	rpcClient.DryRun = *dryRun
+	rpcClient.PreserveMetadata = *preserve
+	rpcClient.Rehash = *rehash
+	rpcClient.Parallelism = *parallelism
+	if *ignorePatterns != "" {
+		rpcClient.IgnorePatterns = strings.Split(*ignorePatterns, ",")
+	}
+	if *useTLS || *caFile != "" {
+		dialOpt, err := surfstore.NewTLSDialOption(*caFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load CA file: %v\n", err)
+			os.Exit(EX_USAGE)
+		}
+		rpcClient.DialOptions = append(rpcClient.DialOptions, dialOpt)
+	}
+
+	switch {
+	case *snapshot != "":
+		var created surfstore.Snapshot
+		if err := rpcClient.CreateSnapshot(*snapshot, &created); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create snapshot: %v\n", err)
+			os.Exit(EX_UNAVAILABLE)
+		}
+		surfstore.PrintSnapshots([]*surfstore.Snapshot{&created})
+	case *listSnapshots:
+		var snapshots []*surfstore.Snapshot
+		if err := rpcClient.ListSnapshots(&snapshots); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list snapshots: %v\n", err)
+			os.Exit(EX_UNAVAILABLE)
+		}
+		surfstore.PrintSnapshots(snapshots)
+	case *checkout != "":
+		if err := surfstore.CheckoutSnapshot(rpcClient, *checkout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to check out snapshot: %v\n", err)
+			os.Exit(EX_UNAVAILABLE)
+		}
+	case *showUsage:
+		var usage surfstore.Usage
+		if err := rpcClient.GetUsage(&usage); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get usage: %v\n", err)
+			os.Exit(EX_UNAVAILABLE)
+		}
+		surfstore.PrintUsage(&usage)
+	case *listFiles:
+		visit := func(fmd *surfstore.FileMetaData) error {
+			surfstore.PrintFile(fmd)
+			return nil
+		}
+		if _, err := surfstore.WalkFiles(rpcClient, *prefix, false, visit); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list files: %v\n", err)
+			os.Exit(EX_UNAVAILABLE)
+		}
+	default:
+		if err := surfstore.ClientSync(rpcClient); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to sync: %v\n", err)
+			os.Exit(EX_UNAVAILABLE)
+		}
+	}
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// Arguments
+const ARG_COUNT int = 1
+
+// Usage strings
+const USAGE_STRING = "./run-rebalance.sh -d -from addrs -to addrs -replication-factor r -rate blocks/s -state file -admin-token token -tls -ca file host:port"
+
+const DEBUG_NAME = "d"
+const DEBUG_USAGE = "Output log statements"
+
+const FROM_NAME = "from"
+const FROM_USAGE = "Comma separated BlockStore addresses before the change, defaults to the MetaStore's previous BlockStores"
+
+const TO_NAME = "to"
+const TO_USAGE = "Comma separated BlockStore addresses after the change, defaults to the MetaStore's BlockStores"
+
+const REPLICATION_NAME = "replication-factor"
+const REPLICATION_USAGE = "Number of BlockStores each block is stored on"
+
+const RATE_NAME = "rate"
+const RATE_USAGE = "Blocks copied per second, 0 is unlimited"
+
+const STATE_NAME = "state"
+const STATE_USAGE = "File recording progress, so an interrupted rebalance resumes where it stopped"
+
+const ADMIN_TOKEN_NAME = "admin-token"
+const ADMIN_TOKEN_USAGE = "The BlockStores' admin token, without it moved blocks are kept on their previous BlockStores"
+
+const TLS_NAME = "tls"
+const TLS_USAGE = "Connect to the servers over TLS, verifying their certificates against the system's roots"
+
+const CA_NAME = "ca"
+const CA_USAGE = "PEM file of the CA certificates the servers' certificates are verified against, implies -tls"
+
+const ADDR_NAME = "host:port"
+const ADDR_USAGE = "IP address and port of the MetaStore whose blocks are rebalanced"
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_UNAVAILABLE int = 69
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", FROM_NAME, FROM_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TO_NAME, TO_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REPLICATION_NAME, REPLICATION_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RATE_NAME, RATE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", STATE_NAME, STATE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", ADMIN_TOKEN_NAME, ADMIN_TOKEN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_NAME, TLS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CA_NAME, CA_USAGE)
+		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
+	}
+
+	// Parse command-line arguments and flags
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	from := flag.String(FROM_NAME, "", FROM_USAGE)
+	to := flag.String(TO_NAME, "", TO_USAGE)
+	replicationFactor := flag.Int(REPLICATION_NAME, 1, REPLICATION_USAGE)
+	rate := flag.Int(RATE_NAME, 0, RATE_USAGE)
+	stateFile := flag.String(STATE_NAME, "", STATE_USAGE)
+	adminToken := flag.String(ADMIN_TOKEN_NAME, "", ADMIN_TOKEN_USAGE)
+	useTLS := flag.Bool(TLS_NAME, false, TLS_USAGE)
+	caFile := flag.String(CA_NAME, "", CA_USAGE)
+	flag.Parse()
+
+	// Use tail arguments to hold non-flag arguments
+	args := flag.Args()
+
+	if len(args) != ARG_COUNT || *replicationFactor < 1 || *rate < 0 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// Disable log outputs if debug flag is missing
+	if !(*debug) {
+		log.SetFlags(0)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	rpcClient := surfstore.NewSurfstoreRPCClient(args[0], "", 0)
+	if *useTLS || *caFile != "" {
+		dialOpt, err := surfstore.NewTLSDialOption(*caFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load CA file: %v\n", err)
+			os.Exit(EX_USAGE)
+		}
+		rpcClient.DialOptions = append(rpcClient.DialOptions, dialOpt)
+	}
+	var blockStoreAddrs surfstore.BlockStoreAddrs
+	if err := rpcClient.GetBlockStoreAddrs(&blockStoreAddrs); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get BlockStore addresses: %v\n", err)
+		os.Exit(EX_UNAVAILABLE)
+	}
+	rebalancer := &surfstore.Rebalancer{
+		From:              blockStoreAddrs.GetPreviousAddrs(),
+		To:                blockStoreAddrs.GetAddrs(),
+		ReplicationFactor: *replicationFactor,
+		BlocksPerSecond:   *rate,
+		StateFile:         *stateFile,
+		DialOptions:       rpcClient.DialOptions,
+		AdminToken:        *adminToken,
+	}
+	if *from != "" {
+		rebalancer.From = strings.Split(*from, ",")
+	}
+	if *to != "" {
+		rebalancer.To = strings.Split(*to, ",")
+	}
+	if len(rebalancer.From) == 0 {
+		fmt.Fprintf(os.Stderr, "The MetaStore has no previous BlockStores, pass -%s\n", FROM_NAME)
+		os.Exit(EX_USAGE)
+	}
+
+	hashes, err := surfstore.FetchReferencedBlockHashes(rpcClient)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list blocks: %v\n", err)
+		os.Exit(EX_UNAVAILABLE)
+	}
+	copied, err := rebalancer.Run(context.Background(), hashes)
+	fmt.Printf("Copied %v of %v blocks to their new BlockStores\n", copied, len(hashes))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Rebalance stopped, rerun to resume: %v\n", err)
+		os.Exit(EX_UNAVAILABLE)
+	}
+}
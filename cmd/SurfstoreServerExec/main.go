@@ -1,27 +1,44 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
-
-// Set of valid services
-var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
+const USAGE_STRING = "./run-server.sh -config <file> -s <service_type> -p <port> -l -d -tombstone-retention <duration> -quota-bytes <bytes> -quota-files <count> -shutdown-timeout <duration> -reflection -advertise <addr> -replication-factor <r> -replication-interval <duration> -data-shards <k> -parity-shards <m> -previous-blockstores <addrs> -rebalance-interval <duration> -rebalance-rate <blocks/s> -block-cache-bytes <bytes> -admin-token <token> (blockStoreAddr*)"
 
 // Exit codes
 const EX_USAGE int = 64
+const EX_SOFTWARE int = 70
+const EX_CONFIG int = 78
+
+// READY_CHECK_INTERVAL is how often services that are not ready yet are checked again
+const READY_CHECK_INTERVAL time.Duration = time.Second
+
+// Errors of a server that stopped without a clean drain
+var errShutdownTimeout = errors.New("in-flight calls did not finish before the shutdown timeout")
+var errFlushFailed = errors.New("failed to flush storage")
 
 func main() {
 	// Custom flag Usage message
@@ -31,75 +48,262 @@ func main() {
 		flag.VisitAll(func(f *flag.Flag) {
 			fmt.Fprintf(w, "  -%s: %v\n", f.Name, f.Usage)
 		})
-		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Address (include self if service type is both)\n")
+		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Addresses (include self if service type is both or block)\n")
 	}
 
 	// Parse command-line argument flags
-	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both")
-	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
-	localOnly := flag.Bool("l", false, "Only listen on localhost")
-	debug := flag.Bool("d", false, "Output log statements")
+	configFile := flag.String("config", "", "JSON config file, flags override its settings")
+	surfstore.RegisterServerFlags(flag.CommandLine)
 	flag.Parse()
 
-	// Use tail arguments to hold BlockStore address
-	args := flag.Args()
-	blockStoreAddr := ""
-	if len(args) == 1 {
-		blockStoreAddr = args[0]
+	config := surfstore.NewServerConfig()
+	if *configFile != "" {
+		var err error
+		if config, err = surfstore.LoadServerConfig(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+			os.Exit(EX_CONFIG)
+		}
 	}
 
-	// Valid service type argument
-	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok {
-		flag.Usage()
-		os.Exit(EX_USAGE)
-	}
+	// flags given on the command line, and the BlockStore addresses in the
+	// tail arguments, override the config file
+	config.ApplyFlags(flag.CommandLine)
 
-	// Add localhost if necessary
-	addr := ""
-	if *localOnly {
-		addr += "localhost"
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		if *configFile == "" {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+		os.Exit(EX_CONFIG)
 	}
-	addr += ":" + strconv.Itoa(*port)
 
 	// Disable log outputs if debug flag is missing
-	if !(*debug) {
+	if config.LogLevel != surfstore.LOG_LEVEL_DEBUG {
 		log.SetFlags(0)
 		log.SetOutput(ioutil.Discard)
 	}
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	err := startServer(config)
+	if errors.Is(err, errShutdownTimeout) || errors.Is(err, errFlushFailed) {
+		fmt.Fprintf(os.Stderr, "Stopped: %v\n", err)
+		os.Exit(EX_SOFTWARE)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Stopped")
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+func startServer(config *surfstore.ServerConfig) error {
 	// Create a new RPC server
-	grpcServer := grpc.NewServer()
+	var opts []grpc.ServerOption
+	// the other servers listen with TLS too, so they are dialed with it
+	var dialOpts []grpc.DialOption
+	if config.TLS != nil {
+		creds, err := credentials.NewServerTLSFromFile(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load TLS files: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+		dialOpt, err := surfstore.NewTLSDialOption(config.TLS.CAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load TLS CA file: %v", err)
+		}
+		dialOpts = append(dialOpts, dialOpt)
+	}
+	if config.Limits.MaxMessageBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(config.Limits.MaxMessageBytes))
+	}
+	// calls that arrive while the server drains are turned away
+	var draining int32
+	opts = append(opts, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if atomic.LoadInt32(&draining) == 1 {
+			return nil, status.Error(codes.Unavailable, "server is shutting down")
+		}
+		return handler(ctx, req)
+	}))
+	grpcServer := grpc.NewServer(opts...)
 
+	serviceType := config.Service
 	log.Printf("service type: %v\n", serviceType)
-	log.Printf("block store addr: %v\n", blockStoreAddr)
+	log.Printf("block store addrs: %v\n", config.BlockStoreAddrs)
 
-	// Register RPC services
-	if serviceType == "both" {
-		metaStore := surfstore.NewMetaStore(blockStoreAddr)
-		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
+	// replication and rebalancing run until the server drains, and are
+	// stopped before storage is flushed
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	var backgroundDone []<-chan struct{}
 
-		blockStore := surfstore.NewBlockStore()
-		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
-	} else if serviceType == "block" {
-		blockStore := surfstore.NewBlockStore()
-		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
-	} else {
-		metaStore := surfstore.NewMetaStore(blockStoreAddr)
+	// Register RPC services, each with the check of its readiness
+	var blockStore *surfstore.BlockStore
+	var services []string
+	checks := make(map[string]func() error)
+	if serviceType == "both" || serviceType == "meta" {
+		metaStore, rebalancer := newMetaStore(config, dialOpts)
 		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
+		services = append(services, surfstore.MetaStore_ServiceDesc.ServiceName)
+		checks[surfstore.MetaStore_ServiceDesc.ServiceName] = metaStore.CheckReady
+		if rebalancer != nil {
+			backgroundDone = append(backgroundDone, metaStore.StartRebalancing(background, time.Duration(config.RebalanceInterval), rebalancer))
+		}
+	}
+	if serviceType == "both" || serviceType == "block" {
+		var err error
+		if blockStore, err = newBlockStore(config, dialOpts); err != nil {
+			return fmt.Errorf("Failed to open block storage: %v", err)
+		}
+		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		services = append(services, surfstore.BlockStore_ServiceDesc.ServiceName)
+		checks[surfstore.BlockStore_ServiceDesc.ServiceName] = blockStore.CheckReady
+		if len(blockStore.Peers) > 1 {
+			backgroundDone = append(backgroundDone, blockStore.StartReplication(background, time.Duration(config.ReplicationInterval)))
+		}
+	}
+
+	// services report NOT_SERVING until their storage is ready, and again once the server drains
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	setServingStatus := func(servingStatus healthpb.HealthCheckResponse_ServingStatus) {
+		healthServer.SetServingStatus("", servingStatus)
+		for _, service := range services {
+			healthServer.SetServingStatus(service, servingStatus)
+		}
+	}
+	setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	if config.Reflection {
+		reflection.Register(grpcServer)
 	}
 
 	// Start listening and serving
-	lis, err := net.Listen("tcp", hostAddr)
+	lis, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		return fmt.Errorf("Failed to listen: %v", err)
 	}
+	backgroundDone = append(backgroundDone, startReadinessChecks(background, healthServer, services, checks))
+
+	// SIGTERM and SIGINT drain in-flight calls, which are cut off after the timeout
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	stopped := make(chan error, 1)
+	go func() {
+		sig := <-signals
+		log.Printf("received %v, draining\n", sig)
+		atomic.StoreInt32(&draining, 1)
+		healthServer.Shutdown()
+
+		drained := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			stopped <- nil
+		case <-time.After(time.Duration(config.ShutdownTimeout)):
+			grpcServer.Stop()
+			stopped <- errShutdownTimeout
+		}
+	}()
 
 	if err := grpcServer.Serve(lis); err != nil {
 		return fmt.Errorf("Failed to serve: %v", err)
 	}
-	return nil
+	err = <-stopped
+
+	stopBackground()
+	for _, done := range backgroundDone {
+		<-done
+	}
+	if blockStore != nil {
+		if flushErr := blockStore.Flush(); flushErr != nil {
+			return fmt.Errorf("%w: %v", errFlushFailed, flushErr)
+		}
+	}
+	return err
+}
+
+// startReadinessChecks sets each service to SERVING once its check passes,
+// and the overall "" service once all of them passed. Failing checks are
+// retried every READY_CHECK_INTERVAL until ctx is cancelled. The returned
+// channel is closed once the checks stopped.
+func startReadinessChecks(ctx context.Context, healthServer *health.Server, services []string, checks map[string]func() error) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pending := services
+		for {
+			notReady := make([]string, 0)
+			for _, service := range pending {
+				if err := checks[service](); err != nil {
+					log.Printf("%v is not ready: %v\n", service, err)
+					notReady = append(notReady, service)
+					continue
+				}
+				healthServer.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+			}
+			if len(notReady) == 0 {
+				healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+				return
+			}
+			pending = notReady
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(READY_CHECK_INTERVAL):
+			}
+		}
+	}()
+	return done
+}
+
+// newMetaStore returns the MetaStore and, with previous BlockStores
+// configured, the Rebalancer that moves their blocks
+func newMetaStore(config *surfstore.ServerConfig, dialOpts []grpc.DialOption) (*surfstore.MetaStore, *surfstore.Rebalancer) {
+	metaStore := surfstore.NewMetaStore(config.BlockStoreAddrs[0])
+	metaStore.BlockStoreAddrs = config.BlockStoreAddrs
+	metaStore.DialOptions = dialOpts
+	metaStore.TombstoneRetention = time.Duration(config.Limits.TombstoneRetention)
+	metaStore.QuotaBytes = config.Limits.QuotaBytes
+	metaStore.QuotaFiles = config.Limits.QuotaFiles
+	if len(config.PreviousBlockStoreAddrs) > 0 {
+		metaStore.PreviousBlockStoreAddrs = config.PreviousBlockStoreAddrs
+		rebalancer := &surfstore.Rebalancer{
+			From:              config.PreviousBlockStoreAddrs,
+			To:                config.BlockStoreAddrs,
+			ReplicationFactor: config.ReplicationFactor,
+			BlocksPerSecond:   config.RebalanceRate,
+			DialOptions:       dialOpts,
+			AdminToken:        config.AdminToken,
+		}
+		if config.DataDir != "" {
+			rebalancer.StateFile = filepath.Join(config.DataDir, surfstore.REBALANCE_STATE_FILENAME)
+		}
+		return metaStore, rebalancer
+	}
+	return metaStore, nil
+}
+
+func newBlockStore(config *surfstore.ServerConfig, dialOpts []grpc.DialOption) (*surfstore.BlockStore, error) {
+	blockStore := surfstore.NewBlockStore()
+	blockStore.DialOptions = dialOpts
+	blockStore.AdminToken = config.AdminToken
+	if config.DataDir != "" {
+		storage, err := surfstore.NewDiskBlockStorage(filepath.Join(config.DataDir, surfstore.BLOCKS_DIRNAME))
+		if err != nil {
+			return nil, err
+		}
+		blockStore.Storage = storage
+		if config.BlockCacheBytes > 0 {
+			blockStore.Storage = surfstore.NewCachedBlockStorage(storage, config.BlockCacheBytes)
+		}
+	}
+	if len(config.BlockStoreAddrs) > 1 {
+		blockStore.Self = config.AdvertiseAddr
+		blockStore.Peers = config.BlockStoreAddrs
+		blockStore.ReplicationFactor = config.ReplicationFactor
+		blockStore.DataShards = config.DataShards
+		blockStore.ParityShards = config.ParityShards
+	}
+	return blockStore, nil
 }
@@ -5,64 +5,199 @@ import (
 	"fmt"
 	"log"
 	sync "sync"
-)
 
-var blockLock sync.Mutex
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
 
 type BlockStore struct {
 	BlockMap map[string]*Block
+	// Storage keeps the blocks instead of BlockMap when set
+	Storage BlockStorage
+	// Self is this BlockStore's address in Peers
+	Self string
+	// Peers are the addresses of all BlockStores, including Self. With peers
+	// each block is stored on ReplicationFactor of them.
+	Peers             []string
+	ReplicationFactor int
+	// With DataShards and ParityShards set, blocks are erasure coded across
+	// the peers instead. ShardMap holds this BlockStore's shards by block hash
+	// and shard index, unless Storage keeps them.
+	DataShards   int
+	ParityShards int
+	ShardMap     map[string]map[int32]*Shard
+	// DialOptions are added to the options peers are dialed with, for
+	// example TLS credentials
+	DialOptions []grpc.DialOption
+	// AdminToken authorizes DeleteBlocks, which only the MetaStore and the
+	// rebalance tool call. Without it DeleteBlocks is refused.
+	AdminToken string
+	// mu guards BlockMap and ShardMap. Lookups share it, so HasBlocks on many
+	// hashes does not hold up GetBlock.
+	mu sync.RWMutex
 	UnimplementedBlockStoreServer
 }
 
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
-	blockLock.Lock()
-	defer blockLock.Unlock()
 	// if err := contextError(ctx); err != nil {
 	// 	return nil, err
 	// }
-	log.Println("get block: ")
-	for key, _ := range bs.BlockMap {
-		log.Println(key)
+	val, ok, err := bs.lookupBlock(blockHash.GetHash())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "reading block %v failed: %v", blockHash.GetHash(), err)
 	}
-	if val, ok := bs.BlockMap[blockHash.GetHash()]; ok {
+	if ok {
 		return val, nil
+	} else if bs.erasureCoded() {
+		return bs.getErasureCoded(blockHash.GetHash())
 	} else {
 		return nil, fmt.Errorf("blockHash does not exist in BlockStore\n")
 	}
 }
 
 func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
-	blockLock.Lock()
-	defer blockLock.Unlock()
 	// if err := contextError(ctx); err != nil {
 	// 	res := &surfstore.Success{
 	// 		flag: false,
 	// 	}
 	// 	return res, err
 	// }
+	if bs.erasureCoded() && !isReplicaWrite(ctx) {
+		return bs.putErasureCoded(block)
+	}
+	if len(bs.Peers) > 1 && !isReplicaWrite(ctx) {
+		return bs.putReplicated(block)
+	}
 
-	hashCode := GetBlockHashString(block.GetBlockData())
-	bs.BlockMap[hashCode] = block
+	if err := bs.storeBlock(block); err != nil {
+		return nil, status.Errorf(codes.Internal, "storing block failed: %v", err)
+	}
 	res := &Success{
 		Flag: true,
 	}
+	return res, nil
+}
+
+func (bs *BlockStore) dialOptions() []grpc.DialOption {
+	return withDefaultDialOptions(bs.DialOptions)
+}
+
+// storeBlock keeps a block in this BlockStore
+func (bs *BlockStore) storeBlock(block *Block) error {
+	hashCode := GetBlockHashString(block.GetBlockData())
+	if bs.Storage != nil {
+		log.Printf("put block: %v\n", hashCode)
+		return bs.Storage.Put(hashCode, block)
+	}
 
-	log.Println("put block: ")
-	for key, _ := range bs.BlockMap {
-		log.Println(key)
+	bs.mu.Lock()
+	bs.BlockMap[hashCode] = block
+	bs.mu.Unlock()
+
+	log.Printf("put block: %v\n", hashCode)
+	return nil
+}
+
+// deleteBlock removes a block kept in this BlockStore
+func (bs *BlockStore) deleteBlock(hash string) error {
+	if bs.Storage != nil {
+		if err := bs.Storage.Delete(hash); err != nil {
+			return err
+		}
 	}
-	// log.Printf("block map: %v\n", bs.BlockMap)
-	return res, nil
+
+	bs.mu.Lock()
+	delete(bs.BlockMap, hash)
+	bs.mu.Unlock()
+
+	log.Printf("delete block: %v\n", hash)
+	return nil
+}
+
+// lookupBlock returns a block kept in this BlockStore
+func (bs *BlockStore) lookupBlock(hash string) (*Block, bool, error) {
+	if bs.Storage != nil {
+		log.Printf("get block: %v\n", hash)
+		return bs.Storage.Get(hash)
+	}
+
+	bs.mu.RLock()
+	block, ok := bs.BlockMap[hash]
+	bs.mu.RUnlock()
+	log.Printf("get block: %v\n", hash)
+	return block, ok, nil
+}
+
+// hasBlock reports whether a block or a shard of it is kept in this BlockStore
+func (bs *BlockStore) hasBlock(hash string) (bool, error) {
+	if bs.Storage != nil {
+		if ok, err := bs.Storage.Has(hash); ok || err != nil {
+			return ok, err
+		}
+	}
+
+	bs.mu.RLock()
+	_, ok := bs.BlockMap[hash]
+	bs.mu.RUnlock()
+	if ok || bs.DataShards == 0 {
+		return ok, nil
+	}
+	shards, err := bs.lookupShards(hash)
+	return len(shards) > 0, err
+}
+
+// blockSize returns the length of a block kept in this BlockStore, or of the
+// block a kept shard belongs to
+func (bs *BlockStore) blockSize(hash string) (int64, bool, error) {
+	if bs.Storage != nil {
+		if size, ok, err := bs.Storage.Size(hash); ok || err != nil {
+			return size, ok, err
+		}
+	}
+
+	bs.mu.RLock()
+	block, ok := bs.BlockMap[hash]
+	bs.mu.RUnlock()
+	if ok {
+		return int64(len(block.GetBlockData())), true, nil
+	}
+	if bs.DataShards == 0 {
+		return 0, false, nil
+	}
+	shards, err := bs.lookupShards(hash)
+	if len(shards) == 0 || err != nil {
+		return 0, false, err
+	}
+	return int64(shards[0].GetBlockSize()), true, nil
+}
+
+// blockHashes lists the hashes of the blocks kept in this BlockStore
+func (bs *BlockStore) blockHashes() ([]string, error) {
+	if bs.Storage != nil {
+		return bs.Storage.Hashes()
+	}
+
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	hashes := make([]string, 0, len(bs.BlockMap))
+	for hash := range bs.BlockMap {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
 }
 
 // Given a list of hashes “in”, returns a list containing the
 // subset of in that are stored in the key-value store
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
-	blockLock.Lock()
-	defer blockLock.Unlock()
 	var found []string
 	for _, blockHash := range blockHashesIn.GetHashes() {
-		if _, ok := bs.BlockMap[blockHash]; ok {
+		ok, err := bs.hasBlock(blockHash)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "checking block %v failed: %v", blockHash, err)
+		}
+		if ok {
 			found = append(found, blockHash)
 		}
 	}
@@ -73,6 +208,128 @@ func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes)
 	return res, nil
 }
 
+// GetBlockSizes returns the length of each of the blocks that this BlockStore
+// holds, or holds a shard of. Blocks it lacks are left out.
+func (bs *BlockStore) GetBlockSizes(ctx context.Context, blockHashes *BlockHashes) (*BlockSizes, error) {
+	sizes := make(map[string]int32)
+	for _, blockHash := range blockHashes.GetHashes() {
+		size, ok, err := bs.blockSize(blockHash)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "checking block %v failed: %v", blockHash, err)
+		}
+		if ok {
+			sizes[blockHash] = int32(size)
+		}
+	}
+	return &BlockSizes{Sizes: sizes}, nil
+}
+
+// DeleteBlocks removes blocks from this BlockStore only. The rebalancer calls
+// it on the previous owners of blocks once their new owners hold them, with
+// the BlockStore's admin token. Blocks this BlockStore still owns among its
+// peers are refused, and blocks it lacks are ignored.
+func (bs *BlockStore) DeleteBlocks(ctx context.Context, blockHashes *BlockHashes) (*Success, error) {
+	if !isAdminCall(ctx, bs.AdminToken) {
+		return nil, status.Error(codes.PermissionDenied, "DeleteBlocks needs the BlockStore's admin token")
+	}
+	if bs.erasureCoded() {
+		return nil, status.Error(codes.FailedPrecondition, "erasure-coded blocks cannot be deleted")
+	}
+	for _, blockHash := range blockHashes.GetHashes() {
+		if bs.ownsBlock(blockHash) {
+			return nil, status.Errorf(codes.FailedPrecondition, "%v still owns block %v", bs.Self, blockHash)
+		}
+	}
+	for _, blockHash := range blockHashes.GetHashes() {
+		if err := bs.deleteBlock(blockHash); err != nil {
+			return nil, status.Errorf(codes.Internal, "deleting block %v failed: %v", blockHash, err)
+		}
+	}
+	return &Success{Flag: true}, nil
+}
+
+// GetCacheStats reports the hits and misses of the block cache in front of
+// Storage, all zero without a cache
+func (bs *BlockStore) GetCacheStats(ctx context.Context, _ *emptypb.Empty) (*CacheStats, error) {
+	if cache, ok := bs.Storage.(*CachedBlockStorage); ok {
+		return cache.Stats(), nil
+	}
+	return &CacheStats{}, nil
+}
+
+// PutShard stores a shard of an erasure-coded block, sent by the BlockStore
+// that encoded it
+func (bs *BlockStore) PutShard(ctx context.Context, shard *Shard) (*Success, error) {
+	if err := bs.storeShard(shard); err != nil {
+		return nil, status.Errorf(codes.Internal, "storing shard %v of %v failed: %v", shard.GetIndex(), shard.GetHash(), err)
+	}
+	return &Success{Flag: true}, nil
+}
+
+// GetShards returns this BlockStore's shards of a block
+func (bs *BlockStore) GetShards(ctx context.Context, blockHash *BlockHash) (*Shards, error) {
+	shards, err := bs.lookupShards(blockHash.GetHash())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "reading shards of %v failed: %v", blockHash.GetHash(), err)
+	}
+	if len(shards) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no shard of %v in BlockStore", blockHash.GetHash())
+	}
+	return &Shards{Shards: shards}, nil
+}
+
+// storeShard keeps a shard in this BlockStore, under its block's hash and
+// its index
+func (bs *BlockStore) storeShard(shard *Shard) error {
+	if bs.Storage != nil {
+		log.Printf("put shard %v of %v\n", shard.GetIndex(), shard.GetHash())
+		return bs.Storage.PutShard(shard)
+	}
+
+	bs.mu.Lock()
+	if bs.ShardMap[shard.GetHash()] == nil {
+		bs.ShardMap[shard.GetHash()] = make(map[int32]*Shard)
+	}
+	bs.ShardMap[shard.GetHash()][shard.GetIndex()] = shard
+	bs.mu.Unlock()
+
+	log.Printf("put shard %v of %v\n", shard.GetIndex(), shard.GetHash())
+	return nil
+}
+
+// lookupShards returns the shards of a block kept in this BlockStore
+func (bs *BlockStore) lookupShards(hash string) ([]*Shard, error) {
+	if bs.Storage != nil {
+		return bs.Storage.Shards(hash)
+	}
+
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	shards := make([]*Shard, 0, len(bs.ShardMap[hash]))
+	for _, shard := range bs.ShardMap[hash] {
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// CheckReady reports an error while Storage cannot store blocks. Without
+// Storage the blocks live in memory and the BlockStore is always ready.
+func (bs *BlockStore) CheckReady() error {
+	if bs.Storage == nil {
+		return nil
+	}
+	return bs.Storage.Check()
+}
+
+// Flush writes the blocks buffered by Storage to durable storage before the
+// server exits. Without Storage the blocks only live in memory.
+func (bs *BlockStore) Flush() error {
+	if bs.Storage == nil {
+		return nil
+	}
+	return bs.Storage.Flush()
+}
+
 // func contextError(ctx context.Context) error {
 // 	switch ctx.Err() {
 // 	case context.Canceled:
@@ -90,5 +347,6 @@ var _ BlockStoreInterface = new(BlockStore)
 func NewBlockStore() *BlockStore {
 	return &BlockStore{
 		BlockMap: map[string]*Block{},
+		ShardMap: map[string]map[int32]*Shard{},
 	}
 }
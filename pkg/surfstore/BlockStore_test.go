@@ -0,0 +1,367 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const benchBlockSize = 4096
+
+// TestMain silences the stores' debug logging
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newBenchBlockStore returns a BlockStore holding n distinct blocks and their hashes
+func newBenchBlockStore(b *testing.B, n int) (*BlockStore, []string) {
+	bs := NewBlockStore()
+	hashes := make([]string, n)
+	for i := range hashes {
+		hashes[i] = putBenchBlock(b, bs, i)
+	}
+	return bs, hashes
+}
+
+func putBenchBlock(b *testing.B, bs *BlockStore, i int) string {
+	data := make([]byte, benchBlockSize)
+	binary.LittleEndian.PutUint64(data, uint64(i))
+	if _, err := bs.PutBlock(context.Background(), &Block{BlockData: data, BlockSize: benchBlockSize}); err != nil {
+		b.Fatal(err)
+	}
+	return GetBlockHashString(data)
+}
+
+// benchGlobalLock stands in for the package-level mutex the stores used to
+// serialize every call through, as the baseline of the parallel benchmarks
+var benchGlobalLock sync.Mutex
+
+// runWithBaseline runs a parallel benchmark twice: with calls going straight
+// to the stores, and with every call serialized through benchGlobalLock
+func runWithBaseline(b *testing.B, bench func(b *testing.B, call func(fn func()))) {
+	b.Run("store-locks", func(b *testing.B) {
+		bench(b, func(fn func()) {
+			fn()
+		})
+	})
+	b.Run("global-lock", func(b *testing.B) {
+		bench(b, func(fn func()) {
+			benchGlobalLock.Lock()
+			defer benchGlobalLock.Unlock()
+			fn()
+		})
+	})
+}
+
+// BenchmarkBlockStoreGetBlockParallel reads blocks from every goroutine at once
+func BenchmarkBlockStoreGetBlockParallel(b *testing.B) {
+	runWithBaseline(b, func(b *testing.B, call func(fn func())) {
+		bs, hashes := newBenchBlockStore(b, 1000)
+		var next uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := atomic.AddUint64(&next, 1)
+			for pb.Next() {
+				i++
+				call(func() {
+					if _, err := bs.GetBlock(context.Background(), &BlockHash{Hash: hashes[i%uint64(len(hashes))]}); err != nil {
+						b.Fatal(err)
+					}
+				})
+			}
+		})
+	})
+}
+
+// BenchmarkBlockStoreGetBlockDuringHasBlocks reads blocks while other
+// goroutines keep checking thousands of hashes with HasBlocks
+func BenchmarkBlockStoreGetBlockDuringHasBlocks(b *testing.B) {
+	runWithBaseline(b, func(b *testing.B, call func(fn func())) {
+		bs, hashes := newBenchBlockStore(b, 10000)
+		done := make(chan struct{})
+		var checkers sync.WaitGroup
+		for c := 0; c < 4; c++ {
+			checkers.Add(1)
+			go func() {
+				defer checkers.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					call(func() {
+						bs.HasBlocks(context.Background(), &BlockHashes{Hashes: hashes})
+					})
+				}
+			}()
+		}
+
+		var next uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := atomic.AddUint64(&next, 1)
+			for pb.Next() {
+				i++
+				call(func() {
+					if _, err := bs.GetBlock(context.Background(), &BlockHash{Hash: hashes[i%uint64(len(hashes))]}); err != nil {
+						b.Fatal(err)
+					}
+				})
+			}
+		})
+		b.StopTimer()
+		close(done)
+		checkers.Wait()
+	})
+}
+
+// BenchmarkBlockStoreMixedParallel puts one block for every nine reads
+func BenchmarkBlockStoreMixedParallel(b *testing.B) {
+	runWithBaseline(b, func(b *testing.B, call func(fn func())) {
+		bs, hashes := newBenchBlockStore(b, 1000)
+		var next uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddUint64(&next, 1)
+				call(func() {
+					if i%10 == 0 {
+						putBenchBlock(b, bs, len(hashes)+int(i))
+						return
+					}
+					if _, err := bs.GetBlock(context.Background(), &BlockHash{Hash: hashes[i%uint64(len(hashes))]}); err != nil {
+						b.Fatal(err)
+					}
+				})
+			}
+		})
+	})
+}
+
+// BenchmarkBlockStoreSeparateInstances writes to two BlockStores in one
+// process, which do not share a lock
+func BenchmarkBlockStoreSeparateInstances(b *testing.B) {
+	runWithBaseline(b, func(b *testing.B, call func(fn func())) {
+		stores := []*BlockStore{NewBlockStore(), NewBlockStore()}
+		var next uint64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddUint64(&next, 1)
+				call(func() {
+					putBenchBlock(b, stores[i%2], int(i))
+				})
+			}
+		})
+	})
+}
+
+// TestDiskBlockStorageShards keeps several shards of one block apart by index
+func TestDiskBlockStorageShards(t *testing.T) {
+	storage, err := NewDiskBlockStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := GetBlockHashString([]byte("block"))
+	for index := int32(0); index < 3; index++ {
+		shard := &Shard{Hash: hash, Index: index, ShardData: []byte{byte(index)}, BlockSize: 5}
+		if err := storage.PutShard(shard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an unfinished write is not a shard
+	if err := os.WriteFile(storage.shardPath(hash, 3)+".tmp123", []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	shards, err := storage.Shards(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 3 {
+		t.Fatalf("%v shards stored, want 3", len(shards))
+	}
+	for _, shard := range shards {
+		if shard.GetHash() != hash || shard.GetBlockSize() != 5 || !bytes.Equal(shard.GetShardData(), []byte{byte(shard.GetIndex())}) {
+			t.Errorf("shard %v read back as %v", shard.GetIndex(), shard)
+		}
+	}
+	if hashes, err := storage.Hashes(); err != nil || len(hashes) != 0 {
+		t.Errorf("shards are listed as blocks %v (%v)", hashes, err)
+	}
+}
+
+// testBlock returns a block of size bytes that differs for each i, and its hash
+func testBlock(i int, size int) (*Block, string) {
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint64(data, uint64(i))
+	return &Block{BlockData: data, BlockSize: int32(size)}, GetBlockHashString(data)
+}
+
+func newTestDiskStorage(t *testing.T) *DiskBlockStorage {
+	storage, err := NewDiskBlockStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestCachedBlockStorageEviction(t *testing.T) {
+	cache := NewCachedBlockStorage(newTestDiskStorage(t), 3*100)
+	hashes := make([]string, 4)
+	for i := 0; i < 3; i++ {
+		var block *Block
+		block, hashes[i] = testBlock(i, 100)
+		if err := cache.Put(hashes[i], block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reading block 0 makes block 1 the least recently used
+	if _, ok, err := cache.Get(hashes[0]); !ok || err != nil {
+		t.Fatalf("block 0: %v, %v", ok, err)
+	}
+	block, hash := testBlock(3, 100)
+	hashes[3] = hash
+	if err := cache.Put(hash, block); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.mu.Lock()
+	for i, hash := range hashes {
+		if _, cached := cache.entries[hash]; cached != (i != 1) {
+			t.Errorf("block %v cached: %v", i, cached)
+		}
+	}
+	cache.mu.Unlock()
+	if stats := cache.Stats(); stats.GetBytes() != 300 || stats.GetBlocks() != 3 {
+		t.Errorf("cache holds %v blocks of %v bytes, want 3 of 300", stats.GetBlocks(), stats.GetBytes())
+	}
+
+	// a block larger than the cache is stored but not cached
+	large, largeHash := testBlock(4, 301)
+	if err := cache.Put(largeHash, large); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.GetBytes() != 300 {
+		t.Errorf("cache holds %v bytes after a block larger than the cache", stats.GetBytes())
+	}
+	if _, ok, err := cache.Get(largeHash); !ok || err != nil {
+		t.Errorf("large block: %v, %v", ok, err)
+	}
+}
+
+func TestCachedBlockStorageStats(t *testing.T) {
+	storage := newTestDiskStorage(t)
+	cache := NewCachedBlockStorage(storage, 1000)
+	block, hash := testBlock(0, 100)
+	if err := storage.Put(hash, block); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first read misses and fills the cache, the next ones hit
+	for i := 0; i < 3; i++ {
+		if _, ok, err := cache.Get(hash); !ok || err != nil {
+			t.Fatalf("read %v: %v, %v", i, ok, err)
+		}
+	}
+	_, missing := testBlock(1, 100)
+	if _, ok, _ := cache.Get(missing); ok {
+		t.Error("a missing block was found")
+	}
+	stats := cache.Stats()
+	if stats.GetHits() != 2 || stats.GetMisses() != 2 {
+		t.Errorf("%v hits and %v misses, want 2 and 2", stats.GetHits(), stats.GetMisses())
+	}
+	if stats.GetCapacityBytes() != 1000 {
+		t.Errorf("capacity %v, want 1000", stats.GetCapacityBytes())
+	}
+}
+
+// deletingStorage deletes each block through the cache right after reading
+// it from disk, as a concurrent Delete would
+type deletingStorage struct {
+	*DiskBlockStorage
+	cache *CachedBlockStorage
+}
+
+func (d *deletingStorage) Get(hash string) (*Block, bool, error) {
+	block, ok, err := d.DiskBlockStorage.Get(hash)
+	if err := d.cache.Delete(hash); err != nil {
+		return nil, false, err
+	}
+	return block, ok, err
+}
+
+func TestCachedBlockStorageDeleteDuringGet(t *testing.T) {
+	backend := &deletingStorage{DiskBlockStorage: newTestDiskStorage(t)}
+	cache := NewCachedBlockStorage(backend, 1000)
+	backend.cache = cache
+	block, hash := testBlock(0, 100)
+	if err := backend.Put(hash, block); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := cache.Get(hash); !ok || err != nil {
+		t.Fatalf("read before the delete: %v, %v", ok, err)
+	}
+	if ok, err := cache.Has(hash); ok || err != nil {
+		t.Errorf("the deleted block is still cached: %v, %v", ok, err)
+	}
+	if _, ok, err := cache.Size(hash); ok || err != nil {
+		t.Errorf("the deleted block still has a size: %v, %v", ok, err)
+	}
+}
+
+func TestDeleteBlocksNeedsAdminToken(t *testing.T) {
+	bs := NewBlockStore()
+	block, hash := testBlock(0, 100)
+	if _, err := bs.PutBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(ADMIN_TOKEN_METADATA_KEY, token))
+	}
+	request := &BlockHashes{Hashes: []string{hash}}
+
+	// without an admin token of its own the BlockStore deletes nothing
+	if _, err := bs.DeleteBlocks(withToken(""), request); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("delete without an admin token returned %v, want PermissionDenied", err)
+	}
+	bs.AdminToken = "secret"
+	for _, ctx := range []context.Context{context.Background(), withToken("wrong")} {
+		if _, err := bs.DeleteBlocks(ctx, request); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("delete with a wrong token returned %v, want PermissionDenied", err)
+		}
+	}
+
+	// a block this BlockStore owns among its peers is kept
+	bs.Self = "self"
+	bs.Peers = []string{"self", "other"}
+	bs.ReplicationFactor = 2
+	if _, err := bs.DeleteBlocks(withToken("secret"), request); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("delete of an owned block returned %v, want FailedPrecondition", err)
+	}
+	if ok, _ := bs.hasBlock(hash); !ok {
+		t.Fatal("an owned block was deleted")
+	}
+
+	bs.Peers = nil
+	if _, err := bs.DeleteBlocks(withToken("secret"), request); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := bs.hasBlock(hash); ok {
+		t.Error("the block was not deleted")
+	}
+}
@@ -2,69 +2,799 @@ package surfstore
 
 import (
 	context "context"
+	"encoding/base64"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	sync "sync"
+	"time"
 
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
-var metaLock sync.Mutex
-
 type MetaStore struct {
 	FileMetaMap    map[string]*FileMetaData
 	BlockStoreAddr string
+	// BlockStoreAddrs are all BlockStores blocks are spread over, BlockStoreAddr alone if empty
+	BlockStoreAddrs []string
+	// PreviousBlockStoreAddrs are the BlockStores before nodes joined or left,
+	// which still hold blocks until rebalancing moved them
+	PreviousBlockStoreAddrs []string
+	// TombstoneRetention is how long deleted files are remembered, 0 keeps them forever
+	TombstoneRetention time.Duration
+	// Snapshots are frozen copies of FileMetaMap by name
+	Snapshots map[string]*Snapshot
+	// QuotaBytes and QuotaFiles limit the logical size and number of files, 0 is unlimited
+	QuotaBytes int64
+	QuotaFiles int64
+	// DialOptions are added to the options the MetaStore dials BlockStores
+	// with, for example TLS credentials
+	DialOptions []grpc.DialOption
+	// mu guards the file map, snapshots and sequences. Reads share it, updates hold it alone.
+	mu sync.RWMutex
+	// epoch identifies this MetaStore's sequence numbers, which start over
+	// when the server restarts
+	epoch string
+	// sequence is the number of the last committed entry, fileSequences the
+	// number each file's current entry was committed with
+	sequence      int64
+	fileSequences map[string]int64
+	// expiredSequence is the highest number of a forgotten tombstone. Cursors
+	// before it may have missed a deletion and get the full file map.
+	expiredSequence int64
+	// filenames are the keys of FileMetaMap in sorted order, for ListFiles,
+	// and snapshotFilenames those of each snapshot's files
+	filenames         []string
+	snapshotFilenames map[string][]string
+	// changes are the committed entries in sequence order, for
+	// GetChangesSince. Entries superseded by a later commit of the same
+	// file, or of a forgotten file, are dropped once they make up half.
+	changes []fileChange
+	// usedBytes and usedFiles are the logical size and number of the files
+	// that are not deleted, kept up to date by commit for the quotas
+	usedBytes int64
+	usedFiles int64
+	// tombstones are the committed deletions in sequence order, which is the
+	// order they expire in. Entries superseded by a later commit of the same
+	// file are skipped, and dropped once they make up half.
+	tombstones []fileChange
 	UnimplementedMetaStoreServer
 }
 
+// fileChange is the sequence number a file's entry was committed with
+type fileChange struct {
+	sequence int64
+	filename string
+}
+
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
-	metaLock.Lock()
-	defer metaLock.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	res := &FileInfoMap{
-		FileInfoMap: m.FileMetaMap,
+		FileInfoMap: m.liveFileInfoMap(),
 	}
 	return res, nil
 }
 
-func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
-	metaLock.Lock()
-	defer metaLock.Unlock()
+// liveFileInfoMap copies the file map without expired tombstones, which are
+// left out here and removed by the next update. Callers must hold mu.
+func (m *MetaStore) liveFileInfoMap() map[string]*FileMetaData {
+	expiry := m.tombstoneExpiry()
+	fileInfoMap := make(map[string]*FileMetaData, len(m.FileMetaMap))
+	for filename, fileMetaData := range m.FileMetaMap {
+		if !tombstoneExpired(fileMetaData, expiry) {
+			fileInfoMap[filename] = fileMetaData
+		}
+	}
+	return fileInfoMap
+}
+
+// GetChangesSince returns the entries committed after a cursor from an earlier
+// call, tombstones included, and the cursor to pass next time. An empty cursor,
+// one from before a restart, or one older than a forgotten tombstone gets the
+// full file map with Full set, which replaces what the caller knows.
+func (m *MetaStore) GetChangesSince(ctx context.Context, changeCursor *ChangeCursor) (*Changes, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cursor := m.cursor()
+	since, ok := m.parseCursor(changeCursor.GetCursor())
+	if !ok || since < m.expiredSequence {
+		return &Changes{FileInfoMap: m.liveFileInfoMap(), Cursor: cursor, Full: true}, nil
+	}
 
+	expiry := m.tombstoneExpiry()
+	fileInfoMap := make(map[string]*FileMetaData)
+	start := sort.Search(len(m.changes), func(i int) bool {
+		return m.changes[i].sequence > since
+	})
+	for _, change := range m.changes[start:] {
+		filename := change.filename
+		if m.fileSequences[filename] != change.sequence {
+			continue
+		}
+		fileMetaData := m.FileMetaMap[filename]
+		// a tombstone that expired before the caller saw it is forgotten
+		if tombstoneExpired(fileMetaData, expiry) {
+			return &Changes{FileInfoMap: m.liveFileInfoMap(), Cursor: cursor, Full: true}, nil
+		}
+		fileInfoMap[filename] = fileMetaData
+	}
+	return &Changes{FileInfoMap: fileInfoMap, Cursor: cursor}, nil
+}
+
+// ListFiles returns one page of the files whose names start with a prefix,
+// sorted by name. The next page starts after the page token of the previous
+// one and the last page has no token. Tombstones are only listed if asked for.
+// Every page carries the change cursor as of that page, so a caller listing
+// the whole namespace can follow up with GetChangesSince from the cursor of
+// its first page. With a snapshot name the pages list the snapshot's files
+// instead and carry no cursor.
+func (m *MetaStore) ListFiles(ctx context.Context, request *ListFilesRequest) (*FileList, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if name := request.GetSnapshot(); name != "" {
+		snapshot, ok := m.Snapshots[name]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "snapshot %v does not exist", name)
+		}
+		filenames, ok := m.snapshotFilenames[name]
+		if !ok {
+			filenames = sortedFilenames(snapshot.GetFileInfoMap())
+		}
+		return listPage(snapshot.GetFileInfoMap(), filenames, request, func(fileMetaData *FileMetaData) bool {
+			return fileMetaData.GetDeleted() && !request.GetIncludeDeleted()
+		})
+	}
+
+	expiry := m.tombstoneExpiry()
+	fileList, err := listPage(m.FileMetaMap, m.filenames, request, func(fileMetaData *FileMetaData) bool {
+		return fileMetaData.GetDeleted() && (!request.GetIncludeDeleted() || tombstoneExpired(fileMetaData, expiry))
+	})
+	if err != nil {
+		return nil, err
+	}
+	fileList.Cursor = m.cursor()
+	return fileList, nil
+}
+
+// listPage returns the page of a ListFiles request from a file map and its
+// sorted keys, leaving out the entries skip returns true for
+func listPage(fileInfoMap map[string]*FileMetaData, filenames []string, request *ListFilesRequest, skip func(fileMetaData *FileMetaData) bool) (*FileList, error) {
+	pageSize := request.GetPageSize()
+	if pageSize <= 0 {
+		pageSize = DEFAULT_LIST_PAGE_SIZE
+	} else if pageSize > MAX_LIST_PAGE_SIZE {
+		pageSize = MAX_LIST_PAGE_SIZE
+	}
+	prefix := request.GetPrefix()
+	start := sort.SearchStrings(filenames, prefix)
+	if request.GetPageToken() != "" {
+		after, err := base64.RawURLEncoding.DecodeString(request.GetPageToken())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token %q", request.GetPageToken())
+		}
+		if i := sort.SearchStrings(filenames, string(after)); i > start {
+			start = i
+		}
+		if start < len(filenames) && filenames[start] == string(after) {
+			start++
+		}
+	}
+
+	fileList := &FileList{}
+	size := 0
+	for i := start; i < len(filenames) && strings.HasPrefix(filenames[i], prefix); i++ {
+		fileMetaData := fileInfoMap[filenames[i]]
+		if skip(fileMetaData) {
+			continue
+		}
+		if int32(len(fileList.Files)) == pageSize || (size >= LIST_PAGE_MAX_BYTES && len(fileList.Files) > 0) {
+			last := fileList.Files[len(fileList.Files)-1].GetFilename()
+			fileList.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		fileList.Files = append(fileList.Files, fileMetaData)
+		size += proto.Size(fileMetaData)
+	}
+	return fileList, nil
+}
+
+// sortedFilenames returns the keys of a file map in sorted order
+func sortedFilenames(fileInfoMap map[string]*FileMetaData) []string {
+	filenames := make([]string, 0, len(fileInfoMap))
+	for filename := range fileInfoMap {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// cursor returns the change cursor of the last committed entry. Callers must hold mu.
+func (m *MetaStore) cursor() string {
+	return fmt.Sprintf("%v-%v", m.epoch, m.sequence)
+}
+
+// parseCursor returns the sequence number of a cursor from this MetaStore's
+// epoch and whether it is one
+func (m *MetaStore) parseCursor(cursor string) (int64, bool) {
+	i := strings.LastIndex(cursor, "-")
+	if i < 0 || cursor[:i] != m.epoch {
+		return 0, false
+	}
+	sequence, err := strconv.ParseInt(cursor[i+1:], 10, 64)
+	if err != nil || sequence < 0 || sequence > m.sequence {
+		return 0, false
+	}
+	return sequence, true
+}
+
+// commit stores an entry under the next sequence number. Callers must hold mu.
+func (m *MetaStore) commit(fileMetaData *FileMetaData) {
+	if m.fileSequences == nil {
+		m.fileSequences = make(map[string]int64)
+	}
 	filename := fileMetaData.GetFilename()
-	// check if file exists in the map
-	if _, ok := m.FileMetaMap[filename]; ok {
-		curr := m.FileMetaMap[filename].GetVersion()
-		new := fileMetaData.GetVersion()
-		log.Printf("curr version %v: %v\n", filename, curr)
-		log.Printf("new version %v: %v\n", fileMetaData.GetFilename(), new)
-		if new-curr == 1 {
-			m.FileMetaMap[filename] = fileMetaData
-			return &Version{Version: fileMetaData.GetVersion()}, nil
-		} else {
-			return &Version{Version: -1}, nil //fmt.Errorf("New version number is not right\n")
+	if curr, ok := m.FileMetaMap[filename]; !ok {
+		i := sort.SearchStrings(m.filenames, filename)
+		m.filenames = append(m.filenames, "")
+		copy(m.filenames[i+1:], m.filenames[i:])
+		m.filenames[i] = filename
+	} else if !curr.GetDeleted() {
+		m.usedBytes -= curr.GetSize()
+		m.usedFiles--
+	}
+	m.sequence++
+	m.FileMetaMap[filename] = fileMetaData
+	m.fileSequences[filename] = m.sequence
+	change := fileChange{sequence: m.sequence, filename: filename}
+	m.changes = append(m.changes, change)
+	if len(m.changes) > 2*len(m.fileSequences) {
+		m.compactChanges()
+	}
+	if !fileMetaData.GetDeleted() {
+		m.usedBytes += fileMetaData.GetSize()
+		m.usedFiles++
+		return
+	}
+	m.tombstones = append(m.tombstones, change)
+	if len(m.tombstones) > 2*(len(m.fileSequences)-int(m.usedFiles)) {
+		m.compactTombstones()
+	}
+}
+
+// compactChanges drops the entries of changes that are no longer a file's
+// current entry. Callers must hold mu.
+func (m *MetaStore) compactChanges() {
+	changes := m.changes[:0]
+	for _, change := range m.changes {
+		if m.fileSequences[change.filename] == change.sequence {
+			changes = append(changes, change)
+		}
+	}
+	m.changes = changes
+}
+
+// compactTombstones drops the entries of tombstones that are no longer a
+// file's current entry. Callers must hold mu.
+func (m *MetaStore) compactTombstones() {
+	tombstones := make([]fileChange, 0, len(m.tombstones)/2)
+	for _, tombstone := range m.tombstones {
+		if m.fileSequences[tombstone.filename] == tombstone.sequence {
+			tombstones = append(tombstones, tombstone)
+		}
+	}
+	m.tombstones = tombstones
+}
+
+// UpdateFile commits a single file update if the server holds the expected version,
+// 0 for a new file, and the update carries the next version. Otherwise it fails with
+// codes.Aborted and the error details carry the conflict with the server's current metadata.
+func (m *MetaStore) UpdateFile(ctx context.Context, fileUpdate *FileUpdate) (*Version, error) {
+	if err := m.checkSizes([]*FileMetaData{fileUpdate.GetFileMetaData()}); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireTombstones()
+
+	if conflict := m.checkUpdate(fileUpdate); conflict != nil {
+		st, err := status.New(codes.Aborted, "version conflict").WithDetails(conflict)
+		if err != nil {
+			return nil, err
+		}
+		return nil, st.Err()
+	}
+	if err := m.checkQuota([]*FileMetaData{fileUpdate.GetFileMetaData()}); err != nil {
+		return nil, err
+	}
+
+	fileMetaData := fileUpdate.GetFileMetaData()
+	prepareUpdate(fileMetaData)
+	m.commit(fileMetaData)
+	return &Version{Version: fileMetaData.GetVersion()}, nil
+}
+
+// UpdateFiles commits a batch of file updates atomically. Every update must name
+// the version the server currently holds, 0 for a new file, and carry the next
+// version. If any update conflicts nothing is committed and every conflict is
+// reported with the server's current metadata.
+func (m *MetaStore) UpdateFiles(ctx context.Context, fileUpdates *FileUpdates) (*FileUpdateResult, error) {
+	fileMetaDatas := make([]*FileMetaData, 0, len(fileUpdates.GetUpdates()))
+	for _, update := range fileUpdates.GetUpdates() {
+		fileMetaDatas = append(fileMetaDatas, update.GetFileMetaData())
+	}
+	if err := m.checkSizes(fileMetaDatas); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireTombstones()
+
+	seen := make(map[string]bool)
+	conflicts := make([]*FileConflict, 0)
+	for _, update := range fileUpdates.GetUpdates() {
+		fileMetaData := update.GetFileMetaData()
+		filename := fileMetaData.GetFilename()
+		if seen[filename] {
+			return nil, status.Errorf(codes.InvalidArgument, "file %v is updated more than once", filename)
+		}
+		seen[filename] = true
+
+		if conflict := m.checkUpdate(update); conflict != nil {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	if len(conflicts) > 0 {
+		return &FileUpdateResult{Committed: false, Conflicts: conflicts}, nil
+	}
+	if err := m.checkQuota(fileMetaDatas); err != nil {
+		return nil, err
+	}
+
+	for _, update := range fileUpdates.GetUpdates() {
+		fileMetaData := update.GetFileMetaData()
+		prepareUpdate(fileMetaData)
+		m.commit(fileMetaData)
+	}
+	return &FileUpdateResult{Committed: true}, nil
+}
+
+// RenameFile moves a file's entry to a new name in one step. The entry keeps its
+// version history and the old name gets a tombstone. The server must hold the
+// expected version of the old file, and the new name must be free or deleted.
+// The new entry and the tombstone are returned.
+func (m *MetaStore) RenameFile(ctx context.Context, fileRename *FileRename) (*FileInfoMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireTombstones()
+
+	oldFilename := fileRename.GetOldFilename()
+	newFilename := fileRename.GetNewFilename()
+	if oldFilename == "" || newFilename == "" || oldFilename == newFilename {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid rename of %q to %q", oldFilename, newFilename)
+	}
+	curr := m.FileMetaMap[oldFilename]
+	if curr == nil || curr.GetDeleted() {
+		return nil, status.Errorf(codes.NotFound, "file %v does not exist", oldFilename)
+	}
+	if curr.GetVersion() != fileRename.GetExpectedVersion() {
+		conflict := &FileConflict{
+			Filename:        oldFilename,
+			ExpectedVersion: fileRename.GetExpectedVersion(),
+			Current:         curr,
+		}
+		st, err := status.New(codes.Aborted, "version conflict").WithDetails(conflict)
+		if err != nil {
+			return nil, err
+		}
+		return nil, st.Err()
+	}
+	target := m.FileMetaMap[newFilename]
+	if target != nil && !target.GetDeleted() {
+		return nil, status.Errorf(codes.AlreadyExists, "file %v already exists", newFilename)
+	}
+
+	// the moved entry must be newer than a tombstone at the new name
+	moved := proto.Clone(curr).(*FileMetaData)
+	moved.Filename = newFilename
+	moved.Version = curr.GetVersion() + 1
+	if target.GetVersion() >= moved.Version {
+		moved.Version = target.GetVersion() + 1
+	}
+	tombstone := &FileMetaData{
+		Filename:  oldFilename,
+		Version:   curr.GetVersion() + 1,
+		Deleted:   true,
+		DeletedAt: time.Now().UnixNano(),
+	}
+	m.commit(moved)
+	m.commit(tombstone)
+
+	return &FileInfoMap{
+		FileInfoMap: map[string]*FileMetaData{
+			newFilename: moved,
+			oldFilename: tombstone,
+		},
+	}, nil
+}
+
+// checkUpdate returns the conflict between an update and the server's metadata,
+// or nil if the update can be committed. Callers must hold mu.
+func (m *MetaStore) checkUpdate(update *FileUpdate) *FileConflict {
+	filename := update.GetFileMetaData().GetFilename()
+	curr := m.FileMetaMap[filename]
+	expected := update.GetExpectedVersion()
+	log.Printf("curr version %v: %v\n", filename, curr.GetVersion())
+	log.Printf("new version %v: %v\n", filename, update.GetFileMetaData().GetVersion())
+
+	if curr.GetVersion() == expected && update.GetFileMetaData().GetVersion() == expected+1 {
+		return nil
+	}
+	return &FileConflict{
+		Filename:        filename,
+		ExpectedVersion: expected,
+		Current:         curr,
+	}
+}
+
+// checkQuota fails with codes.ResourceExhausted if committing the updates would
+// grow the namespace beyond a quota. Updates that shrink it always pass, so a
+// namespace over quota can still be cleaned up. Callers must hold mu.
+func (m *MetaStore) checkQuota(fileMetaDatas []*FileMetaData) error {
+	if m.QuotaBytes <= 0 && m.QuotaFiles <= 0 {
+		return nil
+	}
+	var deltaBytes, deltaFiles int64
+	for _, fileMetaData := range fileMetaDatas {
+		if curr := m.FileMetaMap[fileMetaData.GetFilename()]; curr != nil && !curr.GetDeleted() {
+			deltaBytes -= curr.GetSize()
+			deltaFiles--
+		}
+		if !fileMetaData.GetDeleted() {
+			deltaBytes += fileMetaData.GetSize()
+			deltaFiles++
 		}
-	} else {
-		log.Printf("curr version %v: %v\n", fileMetaData.GetFilename(), fileMetaData.GetVersion())
-		m.FileMetaMap[filename] = fileMetaData
-		return &Version{Version: fileMetaData.GetVersion()}, nil
+	}
+
+	bytes, files := m.usedBytes, m.usedFiles
+	if m.QuotaBytes > 0 && deltaBytes > 0 && bytes+deltaBytes > m.QuotaBytes {
+		return status.Errorf(codes.ResourceExhausted, "byte quota exceeded: %v of %v bytes used, update adds %v", bytes, m.QuotaBytes, deltaBytes)
+	}
+	if m.QuotaFiles > 0 && deltaFiles > 0 && files+deltaFiles > m.QuotaFiles {
+		return status.Errorf(codes.ResourceExhausted, "file quota exceeded: %v of %v files used, update adds %v", files, m.QuotaFiles, deltaFiles)
+	}
+	return nil
+}
+
+// checkSizes recomputes the size of every updated file from the sizes of its
+// blocks on the BlockStores, so a byte quota cannot be dodged by reporting a
+// smaller size. An update whose size does not match fails with
+// codes.InvalidArgument, one naming a block no BlockStore holds with
+// codes.FailedPrecondition. Without a byte quota sizes are not checked.
+// It dials the BlockStores, so callers must not hold mu.
+func (m *MetaStore) checkSizes(fileMetaDatas []*FileMetaData) error {
+	if m.QuotaBytes <= 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	hashes := make([]string, 0)
+	for _, fileMetaData := range fileMetaDatas {
+		if fileMetaData.GetDeleted() {
+			continue
+		}
+		for _, hash := range fileMetaData.GetBlockHashList() {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	sizes, err := m.blockSizes(hashes)
+	for _, fileMetaData := range fileMetaDatas {
+		if fileMetaData.GetDeleted() {
+			continue
+		}
+		var size int64
+		for _, hash := range fileMetaData.GetBlockHashList() {
+			blockSize, ok := sizes[hash]
+			if !ok && err != nil {
+				return status.Errorf(codes.Unavailable, "size of block %v of %v is unknown: %v", hash, fileMetaData.GetFilename(), err)
+			} else if !ok {
+				return status.Errorf(codes.FailedPrecondition, "block %v of %v is not stored on any BlockStore", hash, fileMetaData.GetFilename())
+			}
+			size += blockSize
+		}
+		if size != fileMetaData.GetSize() {
+			return status.Errorf(codes.InvalidArgument, "%v holds %v bytes, the update reports %v", fileMetaData.GetFilename(), size, fileMetaData.GetSize())
+		}
+	}
+	return nil
+}
+
+// blockSizes asks the BlockStores for the size of each block, trying the
+// BlockStores of each block in ranking order, and the previous BlockStores
+// last, until every size is known. It returns the sizes found and the last
+// error of an unreachable BlockStore.
+func (m *MetaStore) blockSizes(hashes []string) (map[string]int64, error) {
+	m.mu.RLock()
+	addrs := m.BlockStoreAddrs
+	if len(addrs) == 0 {
+		addrs = []string{m.BlockStoreAddr}
+	}
+	previousAddrs := m.PreviousBlockStoreAddrs
+	m.mu.RUnlock()
+
+	rankings := make(map[string][]string, len(hashes))
+	for _, hash := range hashes {
+		ranking := BlockOwners(hash, addrs)
+		current := make(map[string]bool, len(ranking))
+		for _, addr := range ranking {
+			current[addr] = true
+		}
+		for _, addr := range BlockOwners(hash, previousAddrs) {
+			if !current[addr] {
+				ranking = append(ranking, addr)
+			}
+		}
+		rankings[hash] = ranking
+	}
+
+	sizes := make(map[string]int64, len(hashes))
+	var lastErr error
+	pending := hashes
+	for rank := 0; len(pending) > 0; rank++ {
+		batches := make(map[string][]string)
+		for _, hash := range pending {
+			if rank < len(rankings[hash]) {
+				addr := rankings[hash][rank]
+				batches[addr] = append(batches[addr], hash)
+			}
+		}
+		if len(batches) == 0 {
+			break
+		}
+		for addr, batch := range batches {
+			found, err := blockSizesAt(addr, batch, m.dialOptions())
+			if err != nil {
+				log.Printf("block sizes from %v failed: %v\n", addr, err)
+				lastErr = err
+				continue
+			}
+			for hash, size := range found {
+				sizes[hash] = size
+			}
+		}
+
+		missing := make([]string, 0)
+		for _, hash := range pending {
+			if _, ok := sizes[hash]; !ok {
+				missing = append(missing, hash)
+			}
+		}
+		pending = missing
+	}
+	return sizes, lastErr
+}
+
+// CheckReady reports an error until one of the BlockStores answers, since
+// files cannot be synced without any. Clients fail over between BlockStores,
+// so the MetaStore does not wait for all of them.
+func (m *MetaStore) CheckReady() error {
+	m.mu.RLock()
+	addrs := m.BlockStoreAddrs
+	if len(addrs) == 0 {
+		addrs = []string{m.BlockStoreAddr}
+	}
+	m.mu.RUnlock()
+
+	var err error
+	for _, addr := range addrs {
+		if err = pingBlockStore(addr, m.dialOptions()); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no BlockStore is reachable: %v", err)
+}
+
+func (m *MetaStore) dialOptions() []grpc.DialOption {
+	return withDefaultDialOptions(m.DialOptions)
+}
+
+// prepareUpdate dates all deletions with the server clock
+func prepareUpdate(fileMetaData *FileMetaData) {
+	if fileMetaData.GetDeleted() {
+		fileMetaData.DeletedAt = time.Now().UnixNano()
 	}
 }
 
 func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
-	metaLock.Lock()
-	defer metaLock.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	// log.Printf("block store address: %v\n", m.BlockStoreAddr)
 	return &BlockStoreAddr{Addr: m.BlockStoreAddr}, nil
 }
 
+// GetBlockStoreAddrs returns the addresses of all BlockStores. Clients rank
+// them with BlockOwners to find the replicas of a block. While blocks are
+// rebalanced the previous addresses are returned too, so clients can read
+// blocks that did not move yet.
+func (m *MetaStore) GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.BlockStoreAddrs) == 0 {
+		return &BlockStoreAddrs{Addrs: []string{m.BlockStoreAddr}, PreviousAddrs: m.PreviousBlockStoreAddrs}, nil
+	}
+	return &BlockStoreAddrs{Addrs: m.BlockStoreAddrs, PreviousAddrs: m.PreviousBlockStoreAddrs}, nil
+}
+
+// GetUsage reports the logical size and number of files in the namespace and the quotas
+func (m *MetaStore) GetUsage(ctx context.Context, _ *emptypb.Empty) (*Usage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return &Usage{
+		Bytes:      m.usedBytes,
+		Files:      m.usedFiles,
+		QuotaBytes: m.QuotaBytes,
+		QuotaFiles: m.QuotaFiles,
+	}, nil
+}
+
+// CreateSnapshot freezes a copy of the current FileMetaMap under a new name
+func (m *MetaStore) CreateSnapshot(ctx context.Context, snapshotName *SnapshotName) (*Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireTombstones()
+
+	name := snapshotName.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name is empty")
+	}
+	if _, ok := m.Snapshots[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %v already exists", name)
+	}
+
+	fileInfoMap := make(map[string]*FileMetaData, len(m.FileMetaMap))
+	for filename, fileMetaData := range m.FileMetaMap {
+		fileInfoMap[filename] = proto.Clone(fileMetaData).(*FileMetaData)
+	}
+	snapshot := &Snapshot{
+		Name:        name,
+		CreatedAt:   time.Now().UnixNano(),
+		FileCount:   int32(len(fileInfoMap)),
+		FileInfoMap: fileInfoMap,
+	}
+	m.Snapshots[name] = snapshot
+	if m.snapshotFilenames == nil {
+		m.snapshotFilenames = make(map[string][]string)
+	}
+	m.snapshotFilenames[name] = append([]string(nil), m.filenames...)
+	log.Printf("snapshot created: %v\n", name)
+	return &Snapshot{Name: name, CreatedAt: snapshot.CreatedAt, FileCount: snapshot.FileCount}, nil
+}
+
+// ListSnapshots returns every snapshot without its files, oldest first
+func (m *MetaStore) ListSnapshots(ctx context.Context, _ *emptypb.Empty) (*Snapshots, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshots := make([]*Snapshot, 0, len(m.Snapshots))
+	for _, snapshot := range m.Snapshots {
+		snapshots = append(snapshots, &Snapshot{
+			Name:      snapshot.GetName(),
+			CreatedAt: snapshot.GetCreatedAt(),
+			FileCount: snapshot.GetFileCount(),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].GetCreatedAt() < snapshots[j].GetCreatedAt()
+	})
+	return &Snapshots{Snapshots: snapshots}, nil
+}
+
+// GetSnapshot returns a snapshot with its files in one message. ListFiles
+// pages through the files of a snapshot too large for that.
+func (m *MetaStore) GetSnapshot(ctx context.Context, snapshotName *SnapshotName) (*Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshot, ok := m.Snapshots[snapshotName.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "snapshot %v does not exist", snapshotName.GetName())
+	}
+	return snapshot, nil
+}
+
+// ReferencedBlockHashes returns the hashes of every block referenced by the
+// current files or a snapshot. Blocks outside this set are the only ones that
+// may ever be removed from the BlockStore.
+func (m *MetaStore) ReferencedBlockHashes() map[string]bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hashes := make(map[string]bool)
+	addHashes := func(fileInfoMap map[string]*FileMetaData) {
+		for _, fileMetaData := range fileInfoMap {
+			for _, hash := range fileMetaData.GetBlockHashList() {
+				hashes[hash] = true
+			}
+		}
+	}
+	addHashes(m.FileMetaMap)
+	for _, snapshot := range m.Snapshots {
+		addHashes(snapshot.GetFileInfoMap())
+	}
+	return hashes
+}
+
+// tombstoneExpiry returns the deletion time before which tombstones are
+// forgotten, 0 if they are kept forever
+func (m *MetaStore) tombstoneExpiry() int64 {
+	if m.TombstoneRetention <= 0 {
+		return 0
+	}
+	return time.Now().Add(-m.TombstoneRetention).UnixNano()
+}
+
+// tombstoneExpired reports whether a file was deleted before the expiry
+func tombstoneExpired(fileMetaData *FileMetaData, expiry int64) bool {
+	return fileMetaData.GetDeleted() && fileMetaData.GetDeletedAt() < expiry
+}
+
+// expireTombstones forgets deleted files older than the retention period.
+// Tombstones expire in the order they were committed, so only the expired
+// ones are visited. Callers must hold mu.
+func (m *MetaStore) expireTombstones() {
+	expiry := m.tombstoneExpiry()
+	if expiry == 0 {
+		return
+	}
+	for len(m.tombstones) > 0 {
+		tombstone := m.tombstones[0]
+		filename := tombstone.filename
+		if m.fileSequences[filename] == tombstone.sequence {
+			if !tombstoneExpired(m.FileMetaMap[filename], expiry) {
+				break
+			}
+			log.Printf("tombstone expired: %v\n", filename)
+			if tombstone.sequence > m.expiredSequence {
+				m.expiredSequence = tombstone.sequence
+			}
+			delete(m.FileMetaMap, filename)
+			delete(m.fileSequences, filename)
+			i := sort.SearchStrings(m.filenames, filename)
+			m.filenames = append(m.filenames[:i], m.filenames[i+1:]...)
+		}
+		m.tombstones = m.tombstones[1:]
+	}
+}
+
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
 func NewMetaStore(blockStoreAddr string) *MetaStore {
 	// log.Printf("block store addr: %v\n", blockStoreAddr)
 	return &MetaStore{
-		FileMetaMap:    map[string]*FileMetaData{},
-		BlockStoreAddr: blockStoreAddr,
+		FileMetaMap:        map[string]*FileMetaData{},
+		BlockStoreAddr:     blockStoreAddr,
+		TombstoneRetention: DEFAULT_TOMBSTONE_RETENTION,
+		Snapshots:          map[string]*Snapshot{},
+		epoch:              strconv.FormatInt(time.Now().UnixNano(), 36),
+		fileSequences:      map[string]int64{},
 	}
 }
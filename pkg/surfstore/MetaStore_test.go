@@ -0,0 +1,337 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// newBenchMetaStore returns a MetaStore holding n files of one block each
+func newBenchMetaStore(b *testing.B, n int) *MetaStore {
+	m := NewMetaStore("localhost:8081")
+	for i := 0; i < n; i++ {
+		update := &FileUpdate{
+			FileMetaData: &FileMetaData{
+				Filename:      fmt.Sprintf("file%v", i),
+				Version:       1,
+				BlockHashList: []string{GetBlockHashString([]byte(fmt.Sprint(i)))},
+				Size:          1,
+			},
+		}
+		if _, err := m.UpdateFile(context.Background(), update); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return m
+}
+
+// BenchmarkMetaStoreReadsParallel calls the read-only RPCs from every goroutine at once
+func BenchmarkMetaStoreReadsParallel(b *testing.B) {
+	runWithBaseline(b, func(b *testing.B, call func(fn func())) {
+		m := newBenchMetaStore(b, 100)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				call(func() {
+					if _, err := m.GetUsage(context.Background(), &emptypb.Empty{}); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := m.GetBlockStoreAddrs(context.Background(), &emptypb.Empty{}); err != nil {
+						b.Fatal(err)
+					}
+				})
+			}
+		})
+	})
+}
+
+// BenchmarkMetaStoreMixedParallel creates a file for every nine GetFileInfoMap calls
+func BenchmarkMetaStoreMixedParallel(b *testing.B) {
+	runWithBaseline(b, func(b *testing.B, call func(fn func())) {
+		m := newBenchMetaStore(b, 100)
+		var next int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				i := atomic.AddInt64(&next, 1)
+				call(func() {
+					if i%10 != 0 {
+						if _, err := m.GetFileInfoMap(context.Background(), &emptypb.Empty{}); err != nil {
+							b.Fatal(err)
+						}
+						return
+					}
+					// names repeat so the map stays small, repeated creates conflict
+					update := &FileUpdate{
+						FileMetaData: &FileMetaData{
+							Filename: fmt.Sprintf("new%v", i%1000),
+							Version:  1,
+						},
+					}
+					if _, err := m.UpdateFile(context.Background(), update); err != nil && GetConflict(err) == nil {
+						b.Fatal(err)
+					}
+				})
+			}
+		})
+	})
+}
+
+// TestGetChangesSince returns only the current entries committed after a cursor
+func TestGetChangesSince(t *testing.T) {
+	m := NewMetaStore("localhost:8081")
+	update := func(filename string, version int32) {
+		fileUpdate := &FileUpdate{
+			FileMetaData:    &FileMetaData{Filename: filename, Version: version},
+			ExpectedVersion: version - 1,
+		}
+		if _, err := m.UpdateFile(context.Background(), fileUpdate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update("a", 1)
+	update("b", 1)
+	first, err := m.GetChangesSince(context.Background(), &ChangeCursor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough commits of one file to compact the change log
+	for version := int32(2); version <= 10; version++ {
+		update("a", version)
+	}
+	update("c", 1)
+	changes, err := m.GetChangesSince(context.Background(), &ChangeCursor{Cursor: first.GetCursor()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.GetFull() || len(changes.GetFileInfoMap()) != 2 {
+		t.Fatalf("changes = %v, want a and c", changes)
+	}
+	if v := changes.GetFileInfoMap()["a"].GetVersion(); v != 10 {
+		t.Errorf("a has version %v, want 10", v)
+	}
+	if len(m.changes) > 2*len(m.fileSequences) {
+		t.Errorf("change log holds %v entries for %v files", len(m.changes), len(m.fileSequences))
+	}
+
+	none, err := m.GetChangesSince(context.Background(), &ChangeCursor{Cursor: changes.GetCursor()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(none.GetFileInfoMap()) != 0 || none.GetCursor() != changes.GetCursor() {
+		t.Errorf("changes since the latest cursor = %v, want none", none)
+	}
+}
+
+func TestListSnapshotFiles(t *testing.T) {
+	m := NewMetaStore("localhost:8081")
+	for _, filename := range []string{"c", "a", "b"} {
+		fileUpdate := &FileUpdate{FileMetaData: &FileMetaData{Filename: filename, Version: 1}}
+		if _, err := m.UpdateFile(context.Background(), fileUpdate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.CreateSnapshot(context.Background(), &SnapshotName{Name: "s"}); err != nil {
+		t.Fatal(err)
+	}
+	// files created after the snapshot are not listed in it
+	if _, err := m.UpdateFile(context.Background(), &FileUpdate{FileMetaData: &FileMetaData{Filename: "aa", Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := &ListFilesRequest{Snapshot: "s", PageSize: 2}
+	var filenames []string
+	for {
+		fileList, err := m.ListFiles(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fileMetaData := range fileList.GetFiles() {
+			filenames = append(filenames, fileMetaData.GetFilename())
+		}
+		if fileList.GetNextPageToken() == "" {
+			break
+		}
+		request.PageToken = fileList.GetNextPageToken()
+	}
+	if got := strings.Join(filenames, ","); got != "a,b,c" {
+		t.Errorf("snapshot lists %v, want a,b,c", got)
+	}
+
+	if _, err := m.ListFiles(context.Background(), &ListFilesRequest{Snapshot: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("listing a missing snapshot returned %v, want NotFound", err)
+	}
+}
+
+// TestUsageAndTombstoneExpiry checks the running usage totals and that only
+// current tombstones expire
+func TestUsageAndTombstoneExpiry(t *testing.T) {
+	m := NewMetaStore("localhost:8081")
+	m.TombstoneRetention = time.Hour
+	update := func(filename string, version int32, size int64, deleted bool) {
+		fileUpdate := &FileUpdate{
+			FileMetaData:    &FileMetaData{Filename: filename, Version: version, Size: size, Deleted: deleted},
+			ExpectedVersion: version - 1,
+		}
+		if _, err := m.UpdateFile(context.Background(), fileUpdate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkUsage := func(bytes int64, files int64) {
+		t.Helper()
+		usage, err := m.GetUsage(context.Background(), &emptypb.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.GetBytes() != bytes || usage.GetFiles() != files {
+			t.Errorf("usage is %v bytes in %v files, want %v in %v", usage.GetBytes(), usage.GetFiles(), bytes, files)
+		}
+	}
+	update("a", 1, 10, false)
+	update("b", 1, 5, false)
+	update("c", 1, 1, false)
+	checkUsage(16, 3)
+
+	// b's tombstone is superseded by the new b
+	update("a", 2, 0, true)
+	update("b", 2, 0, true)
+	update("b", 3, 7, false)
+	checkUsage(8, 2)
+
+	m.TombstoneRetention = time.Nanosecond
+	update("c", 2, 2, false)
+	checkUsage(9, 2)
+	fileList, err := m.ListFiles(context.Background(), &ListFilesRequest{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filenames []string
+	for _, fileMetaData := range fileList.GetFiles() {
+		filenames = append(filenames, fileMetaData.GetFilename())
+	}
+	if got := strings.Join(filenames, ","); got != "b,c" {
+		t.Errorf("files are %v after a's tombstone expired, want b,c", got)
+	}
+	if len(m.tombstones) != 0 {
+		t.Errorf("%v tombstones are still queued", len(m.tombstones))
+	}
+}
+
+// TestUpdateFileConflicts checks that stale updates fail with codes.Aborted
+// and carry the server's current metadata
+func TestUpdateFileConflicts(t *testing.T) {
+	m := NewMetaStore("localhost:8081")
+	ctx := context.Background()
+	if _, err := m.UpdateFile(ctx, &FileUpdate{FileMetaData: &FileMetaData{Filename: "a", Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdateFile(ctx, &FileUpdate{FileMetaData: &FileMetaData{Filename: "a", Version: 2}, ExpectedVersion: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		update *FileUpdate
+	}{
+		{"stale expected version", &FileUpdate{FileMetaData: &FileMetaData{Filename: "a", Version: 2}, ExpectedVersion: 1}},
+		{"create over an existing file", &FileUpdate{FileMetaData: &FileMetaData{Filename: "a", Version: 1}}},
+		{"version skips ahead", &FileUpdate{FileMetaData: &FileMetaData{Filename: "a", Version: 4}, ExpectedVersion: 2}},
+	}
+	for _, test := range tests {
+		_, err := m.UpdateFile(ctx, test.update)
+		if status.Code(err) != codes.Aborted {
+			t.Errorf("%v: got %v, want Aborted", test.name, err)
+			continue
+		}
+		conflict := GetConflict(err)
+		if conflict == nil {
+			t.Errorf("%v: the error carries no conflict", test.name)
+			continue
+		}
+		if conflict.GetFilename() != "a" || conflict.GetExpectedVersion() != test.update.GetExpectedVersion() || conflict.GetCurrent().GetVersion() != 2 {
+			t.Errorf("%v: conflict = %v", test.name, conflict)
+		}
+	}
+
+	// a new file has no current metadata
+	_, err := m.UpdateFile(ctx, &FileUpdate{FileMetaData: &FileMetaData{Filename: "b", Version: 2}, ExpectedVersion: 1})
+	if conflict := GetConflict(err); conflict == nil || conflict.GetCurrent() != nil {
+		t.Errorf("update of a missing file returned %v", err)
+	}
+	if GetConflict(status.Error(codes.NotFound, "other error")) != nil {
+		t.Error("a NotFound error was taken for a conflict")
+	}
+}
+
+// TestUpdateFilesConflicts checks that a batch with a conflict commits nothing
+// and reports every conflict
+func TestUpdateFilesConflicts(t *testing.T) {
+	m := NewMetaStore("localhost:8081")
+	ctx := context.Background()
+	for _, filename := range []string{"a", "b"} {
+		if _, err := m.UpdateFile(ctx, &FileUpdate{FileMetaData: &FileMetaData{Filename: filename, Version: 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := m.UpdateFiles(ctx, &FileUpdates{Updates: []*FileUpdate{
+		{FileMetaData: &FileMetaData{Filename: "a", Version: 2}, ExpectedVersion: 1},
+		{FileMetaData: &FileMetaData{Filename: "b", Version: 1}},
+		{FileMetaData: &FileMetaData{Filename: "c", Version: 1}},
+		{FileMetaData: &FileMetaData{Filename: "d", Version: 3}, ExpectedVersion: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.GetCommitted() {
+		t.Error("a batch with conflicts was committed")
+	}
+	conflicts := make(map[string]*FileConflict)
+	for _, conflict := range result.GetConflicts() {
+		conflicts[conflict.GetFilename()] = conflict
+	}
+	if len(conflicts) != 2 || conflicts["b"].GetCurrent().GetVersion() != 1 || conflicts["d"] == nil || conflicts["d"].GetCurrent() != nil {
+		t.Errorf("conflicts = %v, want b at version 1 and the missing d", result.GetConflicts())
+	}
+	fileInfoMap, err := m.GetFileInfoMap(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := fileInfoMap.GetFileInfoMap()["a"].GetVersion(); v != 1 || len(fileInfoMap.GetFileInfoMap()) != 2 {
+		t.Errorf("the rejected batch changed the files: %v", fileInfoMap.GetFileInfoMap())
+	}
+
+	_, err = m.UpdateFiles(ctx, &FileUpdates{Updates: []*FileUpdate{
+		{FileMetaData: &FileMetaData{Filename: "c", Version: 1}},
+		{FileMetaData: &FileMetaData{Filename: "c", Version: 1}},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("a batch updating a file twice returned %v, want InvalidArgument", err)
+	}
+}
+
+func TestRenameFileConflict(t *testing.T) {
+	m := NewMetaStore("localhost:8081")
+	ctx := context.Background()
+	for version := int32(1); version <= 2; version++ {
+		update := &FileUpdate{FileMetaData: &FileMetaData{Filename: "a", Version: version}, ExpectedVersion: version - 1}
+		if _, err := m.UpdateFile(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := m.RenameFile(ctx, &FileRename{OldFilename: "a", NewFilename: "b", ExpectedVersion: 1})
+	if conflict := GetConflict(err); conflict == nil || conflict.GetCurrent().GetVersion() != 2 {
+		t.Errorf("a stale rename returned %v, want a conflict with version 2", err)
+	}
+	if _, err := m.RenameFile(ctx, &FileRename{OldFilename: "a", NewFilename: "b", ExpectedVersion: 2}); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,6 +1,25 @@
 package surfstore
 
+import "time"
+
 const DEFAULT_META_FILENAME string = "index.txt"
+const DEFAULT_META_TEMP_FILENAME string = "index.txt.tmp"
+const DEFAULT_IGNORE_FILENAME string = ".surfignore"
+
+// DEFAULT_CURSOR_FILENAME records the MetaStore change cursor index.txt is current to
+const DEFAULT_CURSOR_FILENAME string = "index.cursor"
+const DEFAULT_CURSOR_TEMP_FILENAME string = "index.cursor.tmp"
+
+// DEFAULT_DOWNLOAD_TEMP_PREFIX starts the names of files being downloaded
+// before they are renamed over the synced file
+const DEFAULT_DOWNLOAD_TEMP_PREFIX string = ".surfstore-download-"
+
+// LOCAL_INDEX_FORMAT and LOCAL_INDEX_VERSION identify the local metadata file
+// format in its header line. Files without a header use the legacy comma
+// separated format of filename, version and hash list, where the column
+// indexes below apply.
+const LOCAL_INDEX_FORMAT string = "surfstore-index"
+const LOCAL_INDEX_VERSION int = 2
 
 const FILENAME_INDEX int = 0
 const VERSION_INDEX int = 1
@@ -8,3 +27,43 @@ const HASH_LIST_INDEX int = 2
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+// LEGACY_TOMBSTONE_HASH is the hash list entry older versions used to mark deleted files
+const LEGACY_TOMBSTONE_HASH string = "0"
+
+const DEFAULT_PARALLELISM int = 8
+const DEFAULT_MAX_IN_FLIGHT_BYTES int = 64 * 1024 * 1024
+
+// ListFiles pages hold DEFAULT_LIST_PAGE_SIZE files unless the caller asks
+// for another size up to MAX_LIST_PAGE_SIZE, and end early at
+// LIST_PAGE_MAX_BYTES so a page stays well below gRPC's 4 MB message limit
+const DEFAULT_LIST_PAGE_SIZE int32 = 1000
+const MAX_LIST_PAGE_SIZE int32 = 10000
+const LIST_PAGE_MAX_BYTES int = 1024 * 1024
+
+const DEFAULT_TOMBSTONE_RETENTION time.Duration = 30 * 24 * time.Hour
+
+const DEFAULT_REPLICATION_INTERVAL time.Duration = time.Minute
+
+// DEFAULT_BLOCK_CACHE_BYTES is the memory a BlockStore caches on-disk blocks in
+const DEFAULT_BLOCK_CACHE_BYTES int64 = 64 * 1024 * 1024
+
+// BLOCKS_DIRNAME is the directory in the data dir a BlockStore keeps blocks in
+const BLOCKS_DIRNAME string = "blocks"
+
+const DEFAULT_REBALANCE_INTERVAL time.Duration = time.Minute
+
+// REBALANCE_STATE_FILENAME records background rebalancing progress in the data dir
+const REBALANCE_STATE_FILENAME string = "rebalance.state"
+
+// REPLICA_METADATA_KEY marks PutBlock calls between BlockStores copying a block
+const REPLICA_METADATA_KEY string = "surfstore-replica"
+
+// ADMIN_TOKEN_METADATA_KEY carries the admin token of calls only servers may make
+const ADMIN_TOKEN_METADATA_KEY string = "surfstore-admin-token"
+
+// HAS_BLOCKS_BATCH_SIZE is the most hashes sent in one HasBlocks call between servers
+const HAS_BLOCKS_BATCH_SIZE int = 1000
+
+// DEFAULT_SHUTDOWN_TIMEOUT is how long a stopping server waits for in-flight calls
+const DEFAULT_SHUTDOWN_TIMEOUT time.Duration = 10 * time.Second
@@ -4,10 +4,10 @@ package surfstore
 
 import (
 	context "context"
-	empty "github.com/golang/protobuf/ptypes/empty"
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 // This is a compile-time assertion to ensure that this generated file
@@ -22,6 +22,11 @@ type BlockStoreClient interface {
 	GetBlock(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Block, error)
 	PutBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
 	HasBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+	PutShard(ctx context.Context, in *Shard, opts ...grpc.CallOption) (*Success, error)
+	GetShards(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Shards, error)
+	GetCacheStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CacheStats, error)
+	GetBlockSizes(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockSizes, error)
+	DeleteBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*Success, error)
 }
 
 type blockStoreClient struct {
@@ -59,6 +64,51 @@ func (c *blockStoreClient) HasBlocks(ctx context.Context, in *BlockHashes, opts
 	return out, nil
 }
 
+func (c *blockStoreClient) PutShard(ctx context.Context, in *Shard, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/PutShard", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetShards(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Shards, error) {
+	out := new(Shards)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetShards", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetCacheStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*CacheStats, error) {
+	out := new(CacheStats)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetCacheStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetBlockSizes(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockSizes, error) {
+	out := new(BlockSizes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetBlockSizes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) DeleteBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/DeleteBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BlockStoreServer is the server API for BlockStore service.
 // All implementations must embed UnimplementedBlockStoreServer
 // for forward compatibility
@@ -66,6 +116,11 @@ type BlockStoreServer interface {
 	GetBlock(context.Context, *BlockHash) (*Block, error)
 	PutBlock(context.Context, *Block) (*Success, error)
 	HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	PutShard(context.Context, *Shard) (*Success, error)
+	GetShards(context.Context, *BlockHash) (*Shards, error)
+	GetCacheStats(context.Context, *emptypb.Empty) (*CacheStats, error)
+	GetBlockSizes(context.Context, *BlockHashes) (*BlockSizes, error)
+	DeleteBlocks(context.Context, *BlockHashes) (*Success, error)
 	mustEmbedUnimplementedBlockStoreServer()
 }
 
@@ -82,6 +137,21 @@ func (UnimplementedBlockStoreServer) PutBlock(context.Context, *Block) (*Success
 func (UnimplementedBlockStoreServer) HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HasBlocks not implemented")
 }
+func (UnimplementedBlockStoreServer) PutShard(context.Context, *Shard) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutShard not implemented")
+}
+func (UnimplementedBlockStoreServer) GetShards(context.Context, *BlockHash) (*Shards, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetShards not implemented")
+}
+func (UnimplementedBlockStoreServer) GetCacheStats(context.Context, *emptypb.Empty) (*CacheStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCacheStats not implemented")
+}
+func (UnimplementedBlockStoreServer) GetBlockSizes(context.Context, *BlockHashes) (*BlockSizes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockSizes not implemented")
+}
+func (UnimplementedBlockStoreServer) DeleteBlocks(context.Context, *BlockHashes) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteBlocks not implemented")
+}
 func (UnimplementedBlockStoreServer) mustEmbedUnimplementedBlockStoreServer() {}
 
 // UnsafeBlockStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -149,6 +219,96 @@ func _BlockStore_HasBlocks_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BlockStore_PutShard_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Shard)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).PutShard(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/PutShard",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).PutShard(ctx, req.(*Shard))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetShards_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHash)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetShards(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetShards",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetShards(ctx, req.(*BlockHash))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetCacheStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetCacheStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetCacheStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetCacheStats(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetBlockSizes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetBlockSizes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetBlockSizes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetBlockSizes(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_DeleteBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).DeleteBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/DeleteBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).DeleteBlocks(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BlockStore_ServiceDesc is the grpc.ServiceDesc for BlockStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -168,6 +328,26 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "HasBlocks",
 			Handler:    _BlockStore_HasBlocks_Handler,
 		},
+		{
+			MethodName: "PutShard",
+			Handler:    _BlockStore_PutShard_Handler,
+		},
+		{
+			MethodName: "GetShards",
+			Handler:    _BlockStore_GetShards_Handler,
+		},
+		{
+			MethodName: "GetCacheStats",
+			Handler:    _BlockStore_GetCacheStats_Handler,
+		},
+		{
+			MethodName: "GetBlockSizes",
+			Handler:    _BlockStore_GetBlockSizes_Handler,
+		},
+		{
+			MethodName: "DeleteBlocks",
+			Handler:    _BlockStore_DeleteBlocks_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
@@ -177,9 +357,21 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MetaStoreClient interface {
-	GetFileInfoMap(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
-	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
-	GetBlockStoreAddr(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
+	GetChangesSince(ctx context.Context, in *ChangeCursor, opts ...grpc.CallOption) (*Changes, error)
+	ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*FileList, error)
+	// UpdateFile takes a FileUpdate naming the expected version. Earlier
+	// releases sent a bare FileMetaData, so their clients can't call it: this
+	// is a wire break, and their "0" hash list tombstones are not accepted.
+	UpdateFile(ctx context.Context, in *FileUpdate, opts ...grpc.CallOption) (*Version, error)
+	UpdateFiles(ctx context.Context, in *FileUpdates, opts ...grpc.CallOption) (*FileUpdateResult, error)
+	RenameFile(ctx context.Context, in *FileRename, opts ...grpc.CallOption) (*FileInfoMap, error)
+	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	GetUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Usage, error)
+	CreateSnapshot(ctx context.Context, in *SnapshotName, opts ...grpc.CallOption) (*Snapshot, error)
+	ListSnapshots(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Snapshots, error)
+	GetSnapshot(ctx context.Context, in *SnapshotName, opts ...grpc.CallOption) (*Snapshot, error)
 }
 
 type metaStoreClient struct {
@@ -190,7 +382,7 @@ func NewMetaStoreClient(cc grpc.ClientConnInterface) MetaStoreClient {
 	return &metaStoreClient{cc}
 }
 
-func (c *metaStoreClient) GetFileInfoMap(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*FileInfoMap, error) {
+func (c *metaStoreClient) GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error) {
 	out := new(FileInfoMap)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetFileInfoMap", in, out, opts...)
 	if err != nil {
@@ -199,7 +391,25 @@ func (c *metaStoreClient) GetFileInfoMap(ctx context.Context, in *empty.Empty, o
 	return out, nil
 }
 
-func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error) {
+func (c *metaStoreClient) GetChangesSince(ctx context.Context, in *ChangeCursor, opts ...grpc.CallOption) (*Changes, error) {
+	out := new(Changes)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetChangesSince", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*FileList, error) {
+	out := new(FileList)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ListFiles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileUpdate, opts ...grpc.CallOption) (*Version, error) {
 	out := new(Version)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UpdateFile", in, out, opts...)
 	if err != nil {
@@ -208,7 +418,25 @@ func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts
 	return out, nil
 }
 
-func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error) {
+func (c *metaStoreClient) UpdateFiles(ctx context.Context, in *FileUpdates, opts ...grpc.CallOption) (*FileUpdateResult, error) {
+	out := new(FileUpdateResult)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UpdateFiles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) RenameFile(ctx context.Context, in *FileRename, opts ...grpc.CallOption) (*FileInfoMap, error) {
+	out := new(FileInfoMap)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RenameFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error) {
 	out := new(BlockStoreAddr)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreAddr", in, out, opts...)
 	if err != nil {
@@ -217,13 +445,70 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *empty.Empty
 	return out, nil
 }
 
+func (c *metaStoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error) {
+	out := new(BlockStoreAddrs)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Usage, error) {
+	out := new(Usage)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) CreateSnapshot(ctx context.Context, in *SnapshotName, opts ...grpc.CallOption) (*Snapshot, error) {
+	out := new(Snapshot)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/CreateSnapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) ListSnapshots(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*Snapshots, error) {
+	out := new(Snapshots)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ListSnapshots", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetSnapshot(ctx context.Context, in *SnapshotName, opts ...grpc.CallOption) (*Snapshot, error) {
+	out := new(Snapshot)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetSnapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
 type MetaStoreServer interface {
-	GetFileInfoMap(context.Context, *empty.Empty) (*FileInfoMap, error)
-	UpdateFile(context.Context, *FileMetaData) (*Version, error)
-	GetBlockStoreAddr(context.Context, *empty.Empty) (*BlockStoreAddr, error)
+	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
+	GetChangesSince(context.Context, *ChangeCursor) (*Changes, error)
+	ListFiles(context.Context, *ListFilesRequest) (*FileList, error)
+	// UpdateFile takes a FileUpdate naming the expected version. Earlier
+	// releases sent a bare FileMetaData, so their clients can't call it: this
+	// is a wire break, and their "0" hash list tombstones are not accepted.
+	UpdateFile(context.Context, *FileUpdate) (*Version, error)
+	UpdateFiles(context.Context, *FileUpdates) (*FileUpdateResult, error)
+	RenameFile(context.Context, *FileRename) (*FileInfoMap, error)
+	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	GetUsage(context.Context, *emptypb.Empty) (*Usage, error)
+	CreateSnapshot(context.Context, *SnapshotName) (*Snapshot, error)
+	ListSnapshots(context.Context, *emptypb.Empty) (*Snapshots, error)
+	GetSnapshot(context.Context, *SnapshotName) (*Snapshot, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -231,15 +516,42 @@ type MetaStoreServer interface {
 type UnimplementedMetaStoreServer struct {
 }
 
-func (UnimplementedMetaStoreServer) GetFileInfoMap(context.Context, *empty.Empty) (*FileInfoMap, error) {
+func (UnimplementedMetaStoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
 }
-func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (*Version, error) {
+func (UnimplementedMetaStoreServer) GetChangesSince(context.Context, *ChangeCursor) (*Changes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChangesSince not implemented")
+}
+func (UnimplementedMetaStoreServer) ListFiles(context.Context, *ListFilesRequest) (*FileList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
+}
+func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileUpdate) (*Version, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UpdateFile not implemented")
 }
-func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *empty.Empty) (*BlockStoreAddr, error) {
+func (UnimplementedMetaStoreServer) UpdateFiles(context.Context, *FileUpdates) (*FileUpdateResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFiles not implemented")
+}
+func (UnimplementedMetaStoreServer) RenameFile(context.Context, *FileRename) (*FileInfoMap, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedMetaStoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
+}
+func (UnimplementedMetaStoreServer) GetUsage(context.Context, *emptypb.Empty) (*Usage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsage not implemented")
+}
+func (UnimplementedMetaStoreServer) CreateSnapshot(context.Context, *SnapshotName) (*Snapshot, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSnapshot not implemented")
+}
+func (UnimplementedMetaStoreServer) ListSnapshots(context.Context, *emptypb.Empty) (*Snapshots, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSnapshots not implemented")
+}
+func (UnimplementedMetaStoreServer) GetSnapshot(context.Context, *SnapshotName) (*Snapshot, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSnapshot not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -254,7 +566,7 @@ func RegisterMetaStoreServer(s grpc.ServiceRegistrar, srv MetaStoreServer) {
 }
 
 func _MetaStore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(empty.Empty)
+	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -266,13 +578,49 @@ func _MetaStore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec
 		FullMethod: "/surfstore.MetaStore/GetFileInfoMap",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MetaStoreServer).GetFileInfoMap(ctx, req.(*empty.Empty))
+		return srv.(MetaStoreServer).GetFileInfoMap(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetChangesSince_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChangeCursor)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetChangesSince",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, req.(*ChangeCursor))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_ListFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFilesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ListFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ListFiles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ListFiles(ctx, req.(*ListFilesRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
 func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(FileMetaData)
+	in := new(FileUpdate)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -284,13 +632,49 @@ func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec fun
 		FullMethod: "/surfstore.MetaStore/UpdateFile",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MetaStoreServer).UpdateFile(ctx, req.(*FileMetaData))
+		return srv.(MetaStoreServer).UpdateFile(ctx, req.(*FileUpdate))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_UpdateFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileUpdates)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).UpdateFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/UpdateFiles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).UpdateFiles(ctx, req.(*FileUpdates))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileRename)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RenameFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RenameFile(ctx, req.(*FileRename))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
 func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(empty.Empty)
+	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -302,7 +686,97 @@ func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context,
 		FullMethod: "/surfstore.MetaStore/GetBlockStoreAddr",
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(MetaStoreServer).GetBlockStoreAddr(ctx, req.(*empty.Empty))
+		return srv.(MetaStoreServer).GetBlockStoreAddr(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetUsage(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_CreateSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).CreateSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/CreateSnapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).CreateSnapshot(ctx, req.(*SnapshotName))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_ListSnapshots_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ListSnapshots(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ListSnapshots",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ListSnapshots(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SnapshotName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetSnapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetSnapshot(ctx, req.(*SnapshotName))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -318,14 +792,50 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetFileInfoMap",
 			Handler:    _MetaStore_GetFileInfoMap_Handler,
 		},
+		{
+			MethodName: "GetChangesSince",
+			Handler:    _MetaStore_GetChangesSince_Handler,
+		},
+		{
+			MethodName: "ListFiles",
+			Handler:    _MetaStore_ListFiles_Handler,
+		},
 		{
 			MethodName: "UpdateFile",
 			Handler:    _MetaStore_UpdateFile_Handler,
 		},
+		{
+			MethodName: "UpdateFiles",
+			Handler:    _MetaStore_UpdateFiles_Handler,
+		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _MetaStore_RenameFile_Handler,
+		},
 		{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "GetBlockStoreAddrs",
+			Handler:    _MetaStore_GetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "GetUsage",
+			Handler:    _MetaStore_GetUsage_Handler,
+		},
+		{
+			MethodName: "CreateSnapshot",
+			Handler:    _MetaStore_CreateSnapshot_Handler,
+		},
+		{
+			MethodName: "ListSnapshots",
+			Handler:    _MetaStore_ListSnapshots_Handler,
+		},
+		{
+			MethodName: "GetSnapshot",
+			Handler:    _MetaStore_GetSnapshot_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
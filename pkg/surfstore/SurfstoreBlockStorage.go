@@ -0,0 +1,409 @@
+package surfstore
+
+import (
+	"container/list"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	sync "sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// BlockStorage is a backend keeping the blocks of a BlockStore outside of
+// BlockMap. Implementations are safe for concurrent use.
+type BlockStorage interface {
+	// Put stores a block under its hash
+	Put(hash string, block *Block) error
+	// Get returns the block stored under a hash and whether it exists
+	Get(hash string) (*Block, bool, error)
+	// Has reports whether a block is stored
+	Has(hash string) (bool, error)
+	// Size returns the length of a stored block and whether it exists
+	Size(hash string) (int64, bool, error)
+	// Delete removes a block, a missing block is not an error
+	Delete(hash string) error
+	// Hashes lists the hashes of all stored blocks
+	Hashes() ([]string, error)
+	// PutShard stores a shard of an erasure-coded block under its hash and index
+	PutShard(shard *Shard) error
+	// Shards returns the stored shards of a block
+	Shards(hash string) ([]*Shard, error)
+	// Flush writes buffered blocks to durable storage
+	Flush() error
+	// Check reports an error if blocks cannot be stored
+	Check() error
+}
+
+// isBlockHash reports whether s is a hex SHA-256 hash, the only names the
+// disk storage accepts so hashes from clients cannot escape its directory
+func isBlockHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// DiskBlockStorage keeps each block in a file named by its hash, in a
+// subdirectory named by the hash's first two characters
+type DiskBlockStorage struct {
+	Dir string
+}
+
+func NewDiskBlockStorage(dir string) (*DiskBlockStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DiskBlockStorage{Dir: dir}, nil
+}
+
+func (d *DiskBlockStorage) path(hash string) string {
+	return filepath.Join(d.Dir, hash[:2], hash)
+}
+
+// Put writes the block to a temporary file, fsyncs it and renames it into
+// place, so a crash never leaves a partial block behind
+func (d *DiskBlockStorage) Put(hash string, block *Block) error {
+	if !isBlockHash(hash) {
+		return os.ErrInvalid
+	}
+	return writeFileAtomic(d.path(hash), block.GetBlockData())
+}
+
+// writeFileAtomic writes data to a temporary file next to path, fsyncs it and
+// renames it over path. An existing file is kept, since it holds the same data.
+func writeFileAtomic(path string, data []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (d *DiskBlockStorage) Get(hash string) (*Block, bool, error) {
+	if !isBlockHash(hash) {
+		return nil, false, nil
+	}
+	data, err := os.ReadFile(d.path(hash))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &Block{BlockData: data, BlockSize: int32(len(data))}, true, nil
+}
+
+func (d *DiskBlockStorage) Has(hash string) (bool, error) {
+	if !isBlockHash(hash) {
+		return false, nil
+	}
+	_, err := os.Stat(d.path(hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *DiskBlockStorage) Size(hash string) (int64, bool, error) {
+	if !isBlockHash(hash) {
+		return 0, false, nil
+	}
+	info, err := os.Stat(d.path(hash))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size(), true, nil
+}
+
+func (d *DiskBlockStorage) Delete(hash string) error {
+	if !isBlockHash(hash) {
+		return nil
+	}
+	if err := os.Remove(d.path(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *DiskBlockStorage) Hashes() ([]string, error) {
+	var hashes []string
+	err := filepath.WalkDir(d.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && isBlockHash(entry.Name()) {
+			hashes = append(hashes, entry.Name())
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// shardPath is the file of a shard, next to the file its block would have
+func (d *DiskBlockStorage) shardPath(hash string, index int32) string {
+	return fmt.Sprintf("%v.shard%v", d.path(hash), index)
+}
+
+// PutShard writes the shard with its block size next to the blocks, in a
+// file named by the hash and the shard's index
+func (d *DiskBlockStorage) PutShard(shard *Shard) error {
+	if !isBlockHash(shard.GetHash()) || shard.GetIndex() < 0 {
+		return os.ErrInvalid
+	}
+	data, err := proto.Marshal(shard)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.shardPath(shard.GetHash(), shard.GetIndex()), data)
+}
+
+func (d *DiskBlockStorage) Shards(hash string) ([]*Shard, error) {
+	if !isBlockHash(hash) {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(d.path(hash)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shards []*Shard
+	prefix := hash + ".shard"
+	for _, entry := range entries {
+		// temporary files of unfinished writes have no index as their suffix
+		index, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), prefix))
+		if !strings.HasPrefix(entry.Name(), prefix) || err != nil {
+			continue
+		}
+		data, err := os.ReadFile(d.shardPath(hash, int32(index)))
+		if err != nil {
+			return nil, err
+		}
+		shard := &Shard{}
+		if err := proto.Unmarshal(data, shard); err != nil {
+			return nil, fmt.Errorf("shard %v of %v is corrupt: %v", index, hash, err)
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+// Flush has nothing to write, every block is fsynced when it is put
+func (d *DiskBlockStorage) Flush() error {
+	return nil
+}
+
+// Check writes, fsyncs and removes a probe file, so a missing, full or
+// read-only directory is reported before blocks are put
+func (d *DiskBlockStorage) Check() error {
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(d.Dir, "probe.tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("probe"))
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// CachedBlockStorage serves repeated reads of popular blocks from memory. It
+// keeps the most recently used blocks up to a total size in bytes, and
+// writes go through to the backend.
+type CachedBlockStorage struct {
+	Backend BlockStorage
+
+	mu            sync.Mutex
+	capacityBytes int64
+	bytes         int64
+	order         *list.List
+	entries       map[string]*list.Element
+	hits          int64
+	misses        int64
+	// deletes counts the calls to Delete. A block read or written while it
+	// changed is not cached, since it may have been deleted in the meantime.
+	deletes uint64
+}
+
+type cacheEntry struct {
+	hash  string
+	block *Block
+}
+
+func NewCachedBlockStorage(backend BlockStorage, capacityBytes int64) *CachedBlockStorage {
+	return &CachedBlockStorage{
+		Backend:       backend,
+		capacityBytes: capacityBytes,
+		order:         list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+func (c *CachedBlockStorage) Put(hash string, block *Block) error {
+	deletes := c.deleteCount()
+	if err := c.Backend.Put(hash, block); err != nil {
+		return err
+	}
+	c.add(hash, block, deletes)
+	return nil
+}
+
+func (c *CachedBlockStorage) Get(hash string) (*Block, bool, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(element)
+		c.hits++
+		c.mu.Unlock()
+		return element.Value.(*cacheEntry).block, true, nil
+	}
+	c.misses++
+	deletes := c.deletes
+	c.mu.Unlock()
+
+	block, ok, err := c.Backend.Get(hash)
+	if ok {
+		c.add(hash, block, deletes)
+	}
+	return block, ok, err
+}
+
+func (c *CachedBlockStorage) Has(hash string) (bool, error) {
+	c.mu.Lock()
+	_, ok := c.entries[hash]
+	c.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return c.Backend.Has(hash)
+}
+
+func (c *CachedBlockStorage) Size(hash string) (int64, bool, error) {
+	c.mu.Lock()
+	element, ok := c.entries[hash]
+	c.mu.Unlock()
+	if ok {
+		return int64(len(element.Value.(*cacheEntry).block.GetBlockData())), true, nil
+	}
+	return c.Backend.Size(hash)
+}
+
+func (c *CachedBlockStorage) Delete(hash string) error {
+	c.mu.Lock()
+	if element, ok := c.entries[hash]; ok {
+		c.order.Remove(element)
+		delete(c.entries, hash)
+		c.bytes -= int64(len(element.Value.(*cacheEntry).block.GetBlockData()))
+	}
+	c.deletes++
+	c.mu.Unlock()
+	return c.Backend.Delete(hash)
+}
+
+func (c *CachedBlockStorage) Hashes() ([]string, error) {
+	return c.Backend.Hashes()
+}
+
+// PutShard writes the shard through to the backend, shards are not cached
+func (c *CachedBlockStorage) PutShard(shard *Shard) error {
+	return c.Backend.PutShard(shard)
+}
+
+func (c *CachedBlockStorage) Shards(hash string) ([]*Shard, error) {
+	return c.Backend.Shards(hash)
+}
+
+func (c *CachedBlockStorage) Flush() error {
+	return c.Backend.Flush()
+}
+
+func (c *CachedBlockStorage) Check() error {
+	return c.Backend.Check()
+}
+
+// deleteCount returns the number of calls to Delete so far
+func (c *CachedBlockStorage) deleteCount() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deletes
+}
+
+// add caches a block read or written when Delete had been called deletes
+// times, and evicts the least recently used blocks beyond the capacity.
+// Blocks larger than the whole cache are not cached, and neither are blocks
+// that a Delete since may have removed from the backend.
+func (c *CachedBlockStorage) add(hash string, block *Block, deletes uint64) {
+	size := int64(len(block.GetBlockData()))
+	if size > c.capacityBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.deletes != deletes {
+		return
+	}
+	if element, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[hash] = c.order.PushFront(&cacheEntry{hash: hash, block: block})
+	c.bytes += size
+	for c.bytes > c.capacityBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.hash)
+		c.bytes -= int64(len(entry.block.GetBlockData()))
+	}
+}
+
+// Stats returns the hit and miss counters and the cache's current size
+func (c *CachedBlockStorage) Stats() *CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &CacheStats{
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Blocks:        int64(len(c.entries)),
+		Bytes:         c.bytes,
+		CapacityBytes: c.capacityBytes,
+	}
+}
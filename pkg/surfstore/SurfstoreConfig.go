@@ -0,0 +1,333 @@
+package surfstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Log levels of a server
+const LOG_LEVEL_DEBUG string = "debug"
+const LOG_LEVEL_QUIET string = "quiet"
+
+// ServerConfig declares how a surfstore server runs. It is read from a JSON
+// file, and command-line flags override its fields.
+type ServerConfig struct {
+	// Service is the service type to run: meta, block or both
+	Service string `json:"service"`
+	// Listen is the address the server accepts connections on
+	Listen string `json:"listen"`
+	// BlockStoreAddrs are the BlockStores the MetaStore hands out to clients,
+	// and the peers a BlockStore replicates blocks to
+	BlockStoreAddrs []string `json:"blockStoreAddrs"`
+	// AdvertiseAddr is this BlockStore's entry in BlockStoreAddrs, Listen by default
+	AdvertiseAddr string `json:"advertiseAddr"`
+	// ReplicationFactor is the number of BlockStores each block is stored on
+	ReplicationFactor int `json:"replicationFactor"`
+	// ReplicationInterval is how often a BlockStore restores lost replicas
+	ReplicationInterval Duration `json:"replicationInterval"`
+	// PreviousBlockStoreAddrs are the BlockStores before nodes joined or left.
+	// A MetaStore with them moves blocks to their new owners in the background.
+	PreviousBlockStoreAddrs []string `json:"previousBlockStoreAddrs"`
+	// RebalanceInterval is how often the MetaStore rebalances blocks
+	RebalanceInterval Duration `json:"rebalanceInterval"`
+	// RebalanceRate caps the blocks copied per second, 0 is unlimited
+	RebalanceRate int `json:"rebalanceRate"`
+	// DataShards and ParityShards enable Reed-Solomon erasure coding: each
+	// block is split into DataShards shards plus ParityShards parity shards,
+	// one per BlockStore. With DataDir the shards are kept on disk.
+	DataShards   int `json:"dataShards"`
+	ParityShards int `json:"parityShards"`
+	// DataDir holds a BlockStore's blocks on disk instead of in memory, it
+	// is created if missing
+	DataDir string `json:"dataDir"`
+	// BlockCacheBytes is the memory used to cache on-disk blocks, 0 disables the cache
+	BlockCacheBytes int64 `json:"blockCacheBytes"`
+	// AdminToken is shared by the servers of a cluster: BlockStores only
+	// delete blocks for callers presenting it, and the MetaStore presents it
+	// when it deletes moved blocks while rebalancing
+	AdminToken string           `json:"adminToken"`
+	TLS        *ServerTLSConfig `json:"tls"`
+	LogLevel   string           `json:"logLevel"`
+	// ShutdownTimeout is how long in-flight calls may run after SIGTERM
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// Reflection registers gRPC server reflection for generic tools
+	Reflection bool         `json:"reflection"`
+	Limits     ServerLimits `json:"limits"`
+}
+
+// ServerTLSConfig names the certificate and key the server listens with, and
+// the CA certificates the other servers' certificates are verified against
+// when this server dials them. Without a CAFile the system's roots are used.
+type ServerTLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	CAFile   string `json:"caFile"`
+}
+
+// ServerLimits bounds what clients can store and send
+type ServerLimits struct {
+	TombstoneRetention Duration `json:"tombstoneRetention"`
+	QuotaBytes         int64    `json:"quotaBytes"`
+	QuotaFiles         int64    `json:"quotaFiles"`
+	// MaxMessageBytes is the largest request the server accepts, 0 keeps the gRPC default
+	MaxMessageBytes int `json:"maxMessageBytes"`
+}
+
+// Duration is a time.Duration written as a string such as "720h" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"720h\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// NewServerConfig returns the configuration used when no config file is given
+func NewServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Listen:              ":8080",
+		LogLevel:            LOG_LEVEL_QUIET,
+		ShutdownTimeout:     Duration(DEFAULT_SHUTDOWN_TIMEOUT),
+		ReplicationFactor:   1,
+		ReplicationInterval: Duration(DEFAULT_REPLICATION_INTERVAL),
+		RebalanceInterval:   Duration(DEFAULT_REBALANCE_INTERVAL),
+		BlockCacheBytes:     DEFAULT_BLOCK_CACHE_BYTES,
+		Limits: ServerLimits{
+			TombstoneRetention: Duration(DEFAULT_TOMBSTONE_RETENTION),
+		},
+	}
+}
+
+// LoadServerConfig reads a JSON config file on top of the defaults. Unknown
+// fields are rejected so misspelled settings are not silently ignored.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := NewServerConfig()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return config, nil
+}
+
+// RegisterServerFlags defines the command-line flags that override the
+// fields of a ServerConfig
+func RegisterServerFlags(flags *flag.FlagSet) {
+	flags.String("s", "", "(required) Service Type of the Server: meta, block, both")
+	flags.Int("p", 8080, "(default = 8080) Port to accept connections")
+	flags.Bool("l", false, "Only listen on localhost")
+	flags.Bool("d", false, "Output log statements")
+	flags.Duration("tombstone-retention", DEFAULT_TOMBSTONE_RETENTION, "How long the MetaStore remembers deleted files, 0 keeps them forever")
+	flags.Int64("quota-bytes", 0, "Logical bytes the MetaStore's files may hold, 0 is unlimited")
+	flags.Int64("quota-files", 0, "Number of files the MetaStore may hold, 0 is unlimited")
+	flags.Duration("shutdown-timeout", DEFAULT_SHUTDOWN_TIMEOUT, "How long in-flight calls may run after SIGTERM before the server stops")
+	flags.Bool("reflection", false, "Register gRPC server reflection")
+	flags.String("advertise", "", "This BlockStore's address among the BlockStore addresses, defaults to the listen address")
+	flags.Int("replication-factor", 1, "Number of BlockStores each block is stored on")
+	flags.Duration("replication-interval", DEFAULT_REPLICATION_INTERVAL, "How often BlockStores restore lost replicas")
+	flags.Int("data-shards", 0, "Erasure code blocks into this many data shards, 0 disables erasure coding")
+	flags.Int("parity-shards", 0, "Number of parity shards per erasure-coded block")
+	flags.String("previous-blockstores", "", "Comma separated BlockStore addresses before nodes joined or left, whose blocks the MetaStore rebalances")
+	flags.Duration("rebalance-interval", DEFAULT_REBALANCE_INTERVAL, "How often the MetaStore rebalances blocks")
+	flags.Int("rebalance-rate", 0, "Blocks copied per second while rebalancing, 0 is unlimited")
+	flags.Int64("block-cache-bytes", DEFAULT_BLOCK_CACHE_BYTES, "Memory used to cache blocks stored in the data dir, 0 disables the cache")
+	flags.String("admin-token", "", "Secret shared by the servers that authorizes deleting blocks moved by rebalancing")
+}
+
+// ApplyFlags overrides the fields of the flags given on the command line,
+// which were defined with RegisterServerFlags. Positional arguments replace
+// the BlockStore addresses.
+func (c *ServerConfig) ApplyFlags(flags *flag.FlagSet) {
+	host, port, _ := net.SplitHostPort(c.Listen)
+	listenChanged := false
+	flags.Visit(func(f *flag.Flag) {
+		value := f.Value.(flag.Getter).Get()
+		switch f.Name {
+		case "s":
+			c.Service = strings.ToLower(value.(string))
+		case "p":
+			port = strconv.Itoa(value.(int))
+			listenChanged = true
+		case "l":
+			if value.(bool) {
+				host = "localhost"
+				listenChanged = true
+			}
+		case "d":
+			if value.(bool) {
+				c.LogLevel = LOG_LEVEL_DEBUG
+			}
+		case "tombstone-retention":
+			c.Limits.TombstoneRetention = Duration(value.(time.Duration))
+		case "quota-bytes":
+			c.Limits.QuotaBytes = value.(int64)
+		case "quota-files":
+			c.Limits.QuotaFiles = value.(int64)
+		case "shutdown-timeout":
+			c.ShutdownTimeout = Duration(value.(time.Duration))
+		case "reflection":
+			c.Reflection = value.(bool)
+		case "advertise":
+			c.AdvertiseAddr = value.(string)
+		case "replication-factor":
+			c.ReplicationFactor = value.(int)
+		case "replication-interval":
+			c.ReplicationInterval = Duration(value.(time.Duration))
+		case "data-shards":
+			c.DataShards = value.(int)
+		case "parity-shards":
+			c.ParityShards = value.(int)
+		case "previous-blockstores":
+			c.PreviousBlockStoreAddrs = nil
+			if addrs := value.(string); addrs != "" {
+				c.PreviousBlockStoreAddrs = strings.Split(addrs, ",")
+			}
+		case "rebalance-interval":
+			c.RebalanceInterval = Duration(value.(time.Duration))
+		case "rebalance-rate":
+			c.RebalanceRate = value.(int)
+		case "block-cache-bytes":
+			c.BlockCacheBytes = value.(int64)
+		case "admin-token":
+			c.AdminToken = value.(string)
+		}
+	})
+	if listenChanged {
+		c.Listen = net.JoinHostPort(host, port)
+	}
+	if flags.NArg() > 0 {
+		c.BlockStoreAddrs = flags.Args()
+	}
+}
+
+// Validate checks the configuration and creates the data dir if missing
+func (c *ServerConfig) Validate() error {
+	switch c.Service {
+	case "meta", "block", "both":
+	case "":
+		return fmt.Errorf("service is required: meta, block or both")
+	default:
+		return fmt.Errorf("service must be meta, block or both, got %q", c.Service)
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen address %q is invalid: %v", c.Listen, err)
+	}
+	if c.Service != "block" && len(c.BlockStoreAddrs) == 0 {
+		return fmt.Errorf("blockStoreAddrs is required for service %v", c.Service)
+	}
+	seen := make(map[string]bool)
+	for _, addr := range c.BlockStoreAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("BlockStore address %q is invalid: %v", addr, err)
+		}
+		if seen[addr] {
+			return fmt.Errorf("BlockStore address %v is listed twice", addr)
+		}
+		seen[addr] = true
+	}
+	for _, addr := range c.PreviousBlockStoreAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("previous BlockStore address %q is invalid: %v", addr, err)
+		}
+	}
+	if c.Service != "meta" && len(c.BlockStoreAddrs) > 1 {
+		if c.AdvertiseAddr == "" {
+			c.AdvertiseAddr = c.Listen
+		}
+		if !seen[c.AdvertiseAddr] {
+			return fmt.Errorf("advertiseAddr %v must be one of the BlockStore addresses %v", c.AdvertiseAddr, c.BlockStoreAddrs)
+		}
+	}
+	if c.ReplicationFactor < 1 || (len(c.BlockStoreAddrs) > 0 && c.ReplicationFactor > len(c.BlockStoreAddrs)) {
+		return fmt.Errorf("replicationFactor must be between 1 and the number of BlockStores, got %v", c.ReplicationFactor)
+	}
+	if c.ReplicationInterval <= 0 {
+		return fmt.Errorf("replicationInterval must be positive")
+	}
+	if c.RebalanceInterval <= 0 {
+		return fmt.Errorf("rebalanceInterval must be positive")
+	}
+	if c.RebalanceRate < 0 {
+		return fmt.Errorf("rebalanceRate must not be negative")
+	}
+	if c.DataShards != 0 || c.ParityShards != 0 {
+		if c.DataShards < 1 || c.ParityShards < 1 {
+			return fmt.Errorf("dataShards and parityShards must both be positive to erasure code blocks")
+		}
+		if c.DataShards+c.ParityShards > len(c.BlockStoreAddrs) || c.DataShards+c.ParityShards > 256 {
+			return fmt.Errorf("dataShards plus parityShards must not exceed the number of BlockStores or 256, got %v", c.DataShards+c.ParityShards)
+		}
+		if c.ReplicationFactor > 1 {
+			return fmt.Errorf("replicationFactor and erasure coding cannot be combined")
+		}
+		if len(c.PreviousBlockStoreAddrs) > 0 {
+			return fmt.Errorf("previousBlockStoreAddrs and erasure coding cannot be combined, erasure-coded blocks cannot be rebalanced")
+		}
+	}
+
+	if c.DataDir != "" {
+		if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+			return fmt.Errorf("dataDir %q is unusable: %v", c.DataDir, err)
+		}
+	}
+	if c.BlockCacheBytes < 0 {
+		return fmt.Errorf("blockCacheBytes must not be negative")
+	}
+	if c.TLS != nil {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return fmt.Errorf("tls needs both certFile and keyFile")
+		}
+		files := []string{c.TLS.CertFile, c.TLS.KeyFile}
+		if c.TLS.CAFile != "" {
+			files = append(files, c.TLS.CAFile)
+		}
+		for _, file := range files {
+			if _, err := os.Stat(file); err != nil {
+				return fmt.Errorf("tls file is unusable: %v", err)
+			}
+		}
+	}
+
+	switch c.LogLevel {
+	case LOG_LEVEL_DEBUG, LOG_LEVEL_QUIET:
+	default:
+		return fmt.Errorf("logLevel must be %v or %v, got %q", LOG_LEVEL_DEBUG, LOG_LEVEL_QUIET, c.LogLevel)
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdownTimeout must be positive")
+	}
+	if c.Limits.TombstoneRetention < 0 {
+		return fmt.Errorf("limits.tombstoneRetention must not be negative")
+	}
+	if c.Limits.QuotaBytes < 0 || c.Limits.QuotaFiles < 0 {
+		return fmt.Errorf("limits.quotaBytes and limits.quotaFiles must not be negative")
+	}
+	if c.Limits.MaxMessageBytes < 0 {
+		return fmt.Errorf("limits.maxMessageBytes must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package surfstore
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadServerConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+		check   func(c *ServerConfig) bool
+	}{
+		{
+			name: "settings and defaults",
+			file: `{"service": "both", "blockStoreAddrs": ["localhost:8081"], "limits": {"quotaFiles": 10}}`,
+			check: func(c *ServerConfig) bool {
+				return c.Service == "both" && c.Listen == ":8080" && c.Limits.QuotaFiles == 10 &&
+					c.Limits.TombstoneRetention == Duration(DEFAULT_TOMBSTONE_RETENTION) && c.ReplicationFactor == 1
+			},
+		},
+		{
+			name: "durations",
+			file: `{"shutdownTimeout": "5s", "limits": {"tombstoneRetention": "0s"}}`,
+			check: func(c *ServerConfig) bool {
+				return c.ShutdownTimeout == Duration(5*time.Second) && c.Limits.TombstoneRetention == 0
+			},
+		},
+		{name: "unknown field", file: `{"servce": "meta"}`, wantErr: "unknown field"},
+		{name: "duration as a number", file: `{"shutdownTimeout": 5}`, wantErr: "duration must be a string"},
+		{name: "malformed duration", file: `{"shutdownTimeout": "soon"}`, wantErr: "invalid duration"},
+		{name: "not JSON", file: `service: meta`, wantErr: "invalid character"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(test.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadServerConfig(path)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%v: got %v, want an error with %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !test.check(config) {
+			t.Errorf("%v: loaded %+v", test.name, config)
+		}
+	}
+
+	if _, err := LoadServerConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("a missing config file was loaded")
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *ServerConfig)
+		wantErr string
+	}{
+		{name: "valid", modify: func(c *ServerConfig) {}},
+		{name: "no service", modify: func(c *ServerConfig) { c.Service = "" }, wantErr: "service is required"},
+		{name: "unknown service", modify: func(c *ServerConfig) { c.Service = "all" }, wantErr: "service must be"},
+		{name: "listen address", modify: func(c *ServerConfig) { c.Listen = "8080" }, wantErr: "listen address"},
+		{name: "no BlockStores", modify: func(c *ServerConfig) { c.BlockStoreAddrs = nil }, wantErr: "blockStoreAddrs is required"},
+		{name: "block service alone", modify: func(c *ServerConfig) { c.Service = "block"; c.BlockStoreAddrs = nil }},
+		{
+			name:    "duplicate BlockStore",
+			modify:  func(c *ServerConfig) { c.BlockStoreAddrs = []string{"localhost:8080", "localhost:8080"} },
+			wantErr: "listed twice",
+		},
+		{
+			name:    "self not a peer",
+			modify:  func(c *ServerConfig) { c.BlockStoreAddrs = []string{"localhost:8081", "localhost:8082"} },
+			wantErr: "advertiseAddr",
+		},
+		{
+			name: "advertised peer",
+			modify: func(c *ServerConfig) {
+				c.BlockStoreAddrs = []string{"localhost:8081", "localhost:8082"}
+				c.AdvertiseAddr = "localhost:8082"
+				c.ReplicationFactor = 2
+			},
+		},
+		{name: "replication factor", modify: func(c *ServerConfig) { c.ReplicationFactor = 2 }, wantErr: "replicationFactor must be"},
+		{name: "replication interval", modify: func(c *ServerConfig) { c.ReplicationInterval = 0 }, wantErr: "replicationInterval"},
+		{name: "rebalance rate", modify: func(c *ServerConfig) { c.RebalanceRate = -1 }, wantErr: "rebalanceRate"},
+		{name: "parity shards missing", modify: func(c *ServerConfig) { c.DataShards = 1 }, wantErr: "both be positive"},
+		{
+			name: "too many shards",
+			modify: func(c *ServerConfig) {
+				c.Service = "meta"
+				c.BlockStoreAddrs = []string{"localhost:8081", "localhost:8082"}
+				c.DataShards, c.ParityShards = 2, 1
+			},
+			wantErr: "must not exceed",
+		},
+		{name: "TLS without key", modify: func(c *ServerConfig) { c.TLS = &ServerTLSConfig{CertFile: "cert.pem"} }, wantErr: "both certFile and keyFile"},
+		{name: "log level", modify: func(c *ServerConfig) { c.LogLevel = "verbose" }, wantErr: "logLevel"},
+		{name: "shutdown timeout", modify: func(c *ServerConfig) { c.ShutdownTimeout = 0 }, wantErr: "shutdownTimeout"},
+		{name: "negative quota", modify: func(c *ServerConfig) { c.Limits.QuotaBytes = -1 }, wantErr: "quotaBytes"},
+	}
+	for _, test := range tests {
+		config := NewServerConfig()
+		config.Service = "both"
+		config.Listen = "localhost:8080"
+		config.BlockStoreAddrs = []string{"localhost:8080"}
+		test.modify(config)
+		err := config.Validate()
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%v: got %v, want an error with %q", test.name, err, test.wantErr)
+		}
+	}
+
+	// the data dir is created
+	config := NewServerConfig()
+	config.Service = "block"
+	config.DataDir = filepath.Join(t.TempDir(), "data")
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(config.DataDir); err != nil || !info.IsDir() {
+		t.Errorf("data dir was not created: %v", err)
+	}
+}
+
+// TestApplyFlags checks that flags given on the command line override the
+// config file and flags left out keep it
+func TestApplyFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		check func(c *ServerConfig) bool
+	}{
+		{
+			name: "no flags",
+			check: func(c *ServerConfig) bool {
+				return c.Service == "meta" && c.Listen == "0.0.0.0:9000" && c.Limits.QuotaFiles == 10 &&
+					c.ReplicationFactor == 2 && reflect.DeepEqual(c.BlockStoreAddrs, []string{"a:1", "b:2"})
+			},
+		},
+		{
+			name: "flags override",
+			args: []string{"-s", "BOTH", "-p", "8081", "-quota-files", "0", "-replication-factor", "1", "-d"},
+			check: func(c *ServerConfig) bool {
+				return c.Service == "both" && c.Listen == "0.0.0.0:8081" && c.Limits.QuotaFiles == 0 &&
+					c.ReplicationFactor == 1 && c.LogLevel == LOG_LEVEL_DEBUG
+			},
+		},
+		{
+			name: "localhost keeps the port",
+			args: []string{"-l"},
+			check: func(c *ServerConfig) bool {
+				return c.Listen == "localhost:9000"
+			},
+		},
+		{
+			name: "durations and lists",
+			args: []string{"-tombstone-retention", "1h", "-previous-blockstores", "c:3,d:4", "-admin-token", "secret"},
+			check: func(c *ServerConfig) bool {
+				return c.Limits.TombstoneRetention == Duration(time.Hour) && c.AdminToken == "secret" &&
+					reflect.DeepEqual(c.PreviousBlockStoreAddrs, []string{"c:3", "d:4"})
+			},
+		},
+		{
+			name: "empty list clears",
+			args: []string{"-previous-blockstores", ""},
+			check: func(c *ServerConfig) bool {
+				return c.PreviousBlockStoreAddrs == nil
+			},
+		},
+		{
+			name: "positional BlockStores",
+			args: []string{"-s", "meta", "e:5"},
+			check: func(c *ServerConfig) bool {
+				return reflect.DeepEqual(c.BlockStoreAddrs, []string{"e:5"})
+			},
+		},
+	}
+	for _, test := range tests {
+		config := NewServerConfig()
+		config.Service = "meta"
+		config.Listen = "0.0.0.0:9000"
+		config.BlockStoreAddrs = []string{"a:1", "b:2"}
+		config.PreviousBlockStoreAddrs = []string{"z:9"}
+		config.ReplicationFactor = 2
+		config.Limits.QuotaFiles = 10
+
+		flags := flag.NewFlagSet("server", flag.ContinueOnError)
+		RegisterServerFlags(flags)
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		config.ApplyFlags(flags)
+		if !test.check(config) {
+			t.Errorf("%v: config is %+v", test.name, config)
+		}
+	}
+}
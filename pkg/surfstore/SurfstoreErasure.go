@@ -0,0 +1,354 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"sort"
+	sync "sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reed-Solomon coding over GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+// A block is split into k data shards and m parity shards, and any k of the
+// k+m shards rebuild it.
+
+var galExp [510]byte
+var galLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		galExp[i] = byte(x)
+		galExp[i+255] = byte(x)
+		galLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func galMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return galExp[galLog[a]+galLog[b]]
+}
+
+func galInv(a byte) byte {
+	return galExp[255-galLog[a]]
+}
+
+func galPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return galExp[(galLog[a]*n)%255]
+}
+
+// invertMatrix inverts a square matrix with Gauss-Jordan elimination
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range matrix {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], matrix[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := galInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = galMul(work[c][i], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= galMul(factor, work[c][i])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
+
+// encodingMatrices caches the encoding matrix of each k and m, which callers
+// must not modify
+var encodingMatrices = struct {
+	sync.Mutex
+	byShards map[[2]int][][]byte
+}{byShards: make(map[[2]int][][]byte)}
+
+// encodingMatrix returns the (k+m)×k matrix that turns k data shards into all
+// k+m shards. Its top k rows are the identity, so data shards are stored as is,
+// and every k rows are invertible. Each matrix is computed once.
+func encodingMatrix(k, m int) [][]byte {
+	encodingMatrices.Lock()
+	defer encodingMatrices.Unlock()
+	if matrix, ok := encodingMatrices.byShards[[2]int{k, m}]; ok {
+		return matrix
+	}
+	matrix := newEncodingMatrix(k, m)
+	encodingMatrices.byShards[[2]int{k, m}] = matrix
+	return matrix
+}
+
+func newEncodingMatrix(k, m int) [][]byte {
+	vandermonde := make([][]byte, k+m)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, k)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = galPow(byte(r), c)
+		}
+	}
+	topInverse, err := invertMatrix(vandermonde[:k])
+	if err != nil {
+		log.Fatalf("Vandermonde matrix is singular: %v\n", err)
+	}
+	matrix := make([][]byte, k+m)
+	for r := range matrix {
+		matrix[r] = make([]byte, k)
+		for c := 0; c < k; c++ {
+			var v byte
+			for i := 0; i < k; i++ {
+				v ^= galMul(vandermonde[r][i], topInverse[i][c])
+			}
+			matrix[r][c] = v
+		}
+	}
+	return matrix
+}
+
+// encodeShards splits data into k equally sized data shards, padding the last
+// one with zeros, and computes m parity shards
+func encodeShards(data []byte, k, m int) [][]byte {
+	shardSize := (len(data) + k - 1) / k
+	if shardSize == 0 {
+		shardSize = 1
+	}
+	padded := make([]byte, shardSize*k)
+	copy(padded, data)
+
+	matrix := encodingMatrix(k, m)
+	shards := make([][]byte, k+m)
+	for i := 0; i < k; i++ {
+		shards[i] = padded[i*shardSize : (i+1)*shardSize]
+	}
+	for p := k; p < k+m; p++ {
+		shards[p] = make([]byte, shardSize)
+		for i := 0; i < k; i++ {
+			coef := matrix[p][i]
+			for j, b := range shards[i] {
+				shards[p][j] ^= galMul(coef, b)
+			}
+		}
+	}
+	return shards
+}
+
+// decodeShards rebuilds the data of a block from any k of its shards, keyed
+// by shard index
+func decodeShards(shards map[int][]byte, k, m int, blockSize int) ([]byte, error) {
+	if len(shards) < k {
+		return nil, fmt.Errorf("%v shards available, %v needed", len(shards), k)
+	}
+	indexes := make([]int, 0, len(shards))
+	for index := range shards {
+		if index < 0 || index >= k+m {
+			return nil, fmt.Errorf("shard index %v is out of range for %v shards", index, k+m)
+		}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	indexes = indexes[:k]
+
+	matrix := encodingMatrix(k, m)
+	rows := make([][]byte, k)
+	for r, index := range indexes {
+		rows[r] = matrix[index]
+	}
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	shardSize := len(shards[indexes[0]])
+	data := make([]byte, shardSize*k)
+	for i := 0; i < k; i++ {
+		out := data[i*shardSize : (i+1)*shardSize]
+		for r, index := range indexes {
+			coef := decode[i][r]
+			if coef == 0 {
+				continue
+			}
+			shard := shards[index]
+			if len(shard) != shardSize {
+				return nil, fmt.Errorf("shard %v has %v bytes, expected %v", index, len(shard), shardSize)
+			}
+			for j, b := range shard {
+				out[j] ^= galMul(coef, b)
+			}
+		}
+	}
+	if blockSize > len(data) {
+		return nil, fmt.Errorf("block size %v exceeds the shards' %v bytes", blockSize, len(data))
+	}
+	return data[:blockSize], nil
+}
+
+// erasureCoded reports whether blocks are split into shards across the peers
+func (bs *BlockStore) erasureCoded() bool {
+	return bs.DataShards > 0 && bs.ParityShards > 0 && len(bs.Peers) > 1
+}
+
+// putErasureCoded encodes a block into DataShards+ParityShards shards and
+// stores shard i on the i-th BlockStore in the block's ranking. A shard whose
+// BlockStore fails moves to the next BlockStore after the owners, so every
+// shard lands on a different server. The call fails unless all shards are
+// stored, since fewer would not survive losing ParityShards servers.
+func (bs *BlockStore) putErasureCoded(block *Block) (*Success, error) {
+	hash := GetBlockHashString(block.GetBlockData())
+	ranking := BlockOwners(hash, bs.Peers)
+	k, m := bs.DataShards, bs.ParityShards
+	shards := encodeShards(block.GetBlockData(), k, m)
+
+	type shardResult struct {
+		index int
+		err   error
+	}
+	results := make(chan shardResult, len(ranking))
+	write := func(index int, addr string) {
+		shard := &Shard{
+			Hash:      hash,
+			Index:     int32(index),
+			ShardData: shards[index],
+			BlockSize: int32(len(block.GetBlockData())),
+		}
+		if addr == bs.Self {
+			results <- shardResult{index, bs.storeShard(shard)}
+			return
+		}
+		results <- shardResult{index, putShardAt(addr, shard, bs.dialOptions())}
+	}
+	for i := 0; i < k+m; i++ {
+		go write(i, ranking[i])
+	}
+
+	next, pending, stored := k+m, k+m, 0
+	for pending > 0 {
+		result := <-results
+		pending--
+		if result.err == nil {
+			stored++
+			continue
+		}
+		log.Printf("shard %v of %v failed: %v\n", result.index, hash, result.err)
+		if next < len(ranking) {
+			go write(result.index, ranking[next])
+			next++
+			pending++
+		}
+	}
+	if stored < k+m {
+		return nil, status.Errorf(codes.Unavailable, "block %v stored %v of %v shards", hash, stored, k+m)
+	}
+	return &Success{Flag: true}, nil
+}
+
+// getErasureCoded rebuilds a block from the first DataShards distinct shards
+// returned by the BlockStores
+func (bs *BlockStore) getErasureCoded(hash string) (*Block, error) {
+	results := make(chan []*Shard, len(bs.Peers))
+	for _, addr := range bs.Peers {
+		go func(addr string) {
+			if addr == bs.Self {
+				shards, err := bs.lookupShards(hash)
+				if err != nil {
+					log.Printf("shards of %v failed: %v\n", hash, err)
+				}
+				results <- shards
+				return
+			}
+			shards, err := getShardsAt(addr, hash, bs.dialOptions())
+			if err != nil {
+				log.Printf("shards of %v from %v failed: %v\n", hash, addr, err)
+			}
+			results <- shards
+		}(addr)
+	}
+
+	shards := make(map[int][]byte)
+	blockSize := -1
+	for range bs.Peers {
+		for _, shard := range <-results {
+			shards[int(shard.GetIndex())] = shard.GetShardData()
+			blockSize = int(shard.GetBlockSize())
+		}
+		if len(shards) >= bs.DataShards {
+			break
+		}
+	}
+	if len(shards) < bs.DataShards {
+		return nil, status.Errorf(codes.NotFound, "block %v has %v of the %v shards needed", hash, len(shards), bs.DataShards)
+	}
+
+	data, err := decodeShards(shards, bs.DataShards, bs.ParityShards, blockSize)
+	if err != nil {
+		return nil, status.Errorf(codes.DataLoss, "block %v cannot be rebuilt: %v", hash, err)
+	}
+	if GetBlockHashString(data) != hash {
+		return nil, status.Errorf(codes.DataLoss, "block %v rebuilt with a different hash", hash)
+	}
+	return &Block{BlockData: data, BlockSize: int32(len(data))}, nil
+}
+
+// putShardAt stores a shard on another BlockStore
+func putShardAt(addr string, shard *Shard, opts []grpc.DialOption) error {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = c.PutShard(ctx, shard)
+	return err
+}
+
+// getShardsAt fetches the shards of a block held by another BlockStore
+func getShardsAt(addr string, hash string, opts []grpc.DialOption) ([]*Shard, error) {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shards, err := c.GetShards(ctx, &BlockHash{Hash: hash})
+	return shards.GetShards(), err
+}
@@ -0,0 +1,95 @@
+package surfstore
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// erasureParams are the data and parity shard counts the tests code with
+var erasureParams = [][2]int{{1, 1}, {2, 1}, {2, 2}, {3, 2}, {4, 3}}
+
+func TestInvertMatrix(t *testing.T) {
+	for _, params := range erasureParams {
+		k, m := params[0], params[1]
+		matrix := encodingMatrix(k, m)
+		// the last k rows mix data and parity rows
+		rows := matrix[m:]
+		inverse, err := invertMatrix(rows)
+		if err != nil {
+			t.Fatalf("k=%v m=%v: %v", k, m, err)
+		}
+		for r := 0; r < k; r++ {
+			for c := 0; c < k; c++ {
+				var v byte
+				for i := 0; i < k; i++ {
+					v ^= galMul(rows[r][i], inverse[i][c])
+				}
+				want := byte(0)
+				if r == c {
+					want = 1
+				}
+				if v != want {
+					t.Errorf("k=%v m=%v: product[%v][%v] = %v, want the identity", k, m, r, c, v)
+				}
+			}
+		}
+	}
+
+	if _, err := invertMatrix([][]byte{{1, 2}, {1, 2}}); err == nil {
+		t.Error("a singular matrix was inverted")
+	}
+}
+
+func TestEncodingMatrixIsCached(t *testing.T) {
+	if &encodingMatrix(3, 2)[0][0] != &encodingMatrix(3, 2)[0][0] {
+		t.Error("the encoding matrix was computed again")
+	}
+}
+
+// TestDecodeShards rebuilds blocks from every combination of shards with up
+// to m of them missing
+func TestDecodeShards(t *testing.T) {
+	for _, params := range erasureParams {
+		k, m := params[0], params[1]
+		for _, size := range []int{0, 1, 7, 64, 1000} {
+			data := make([]byte, size)
+			for i := range data {
+				data[i] = byte(i*31 + size)
+			}
+			shards := encodeShards(data, k, m)
+			if len(shards) != k+m {
+				t.Fatalf("k=%v m=%v: %v shards", k, m, len(shards))
+			}
+
+			for present := 0; present < 1<<(k+m); present++ {
+				available := make(map[int][]byte)
+				for i := 0; i < k+m; i++ {
+					if present&(1<<i) != 0 {
+						available[i] = shards[i]
+					}
+				}
+				name := fmt.Sprintf("k=%v m=%v size=%v shards=%b", k, m, size, present)
+				got, err := decodeShards(available, k, m, size)
+				if len(available) < k {
+					if err == nil {
+						t.Errorf("%v: decoded from too few shards", name)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%v: %v", name, err)
+				} else if !bytes.Equal(got, data) {
+					t.Errorf("%v: decoded other data", name)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeShardsRejectsBadIndex(t *testing.T) {
+	shards := encodeShards([]byte("data"), 2, 1)
+	if _, err := decodeShards(map[int][]byte{0: shards[0], 5: shards[1]}, 2, 1, 4); err == nil {
+		t.Error("a shard index beyond k+m was accepted")
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /* Hash Related */
@@ -34,99 +37,335 @@ func ConcatPath(baseDir, fileDir string) string {
 	Reading and Writing Local Metadata File Related
 */
 
-// NewFileMetaDataFromConfig returns a FileMetaData struct
-// associated with one line in the local metadata file.
-func NewFileMetaDataFromConfig(configString string) *FileMetaData {
+// localIndexHeader is the first line of the local metadata file. Metadata files
+// without it use the legacy comma separated format.
+type localIndexHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// localIndexEntry is one line of the local metadata file after the header
+type localIndexEntry struct {
+	Filename      string         `json:"filename"`
+	Version       int32          `json:"version"`
+	BlockHashList []string       `json:"blockHashList"`
+	Mode          uint32         `json:"mode,omitempty"`
+	Mtime         int64          `json:"mtime,omitempty"`
+	SymlinkTarget string         `json:"symlinkTarget,omitempty"`
+	Size          int64          `json:"size,omitempty"`
+	Deleted       bool           `json:"deleted,omitempty"`
+	DeletedAt     int64          `json:"deletedAt,omitempty"`
+	Stat          *LocalFileStat `json:"stat,omitempty"`
+}
+
+// LocalFileStat is the stat data of a base dir file when it was last hashed,
+// and the block size its hash list was cut at. A file whose stat data and
+// block size are unchanged is not hashed again.
+type LocalFileStat struct {
+	Size      int64  `json:"size"`
+	Mtime     int64  `json:"mtime"`
+	Inode     uint64 `json:"inode"`
+	BlockSize int    `json:"blockSize,omitempty"`
+}
+
+// NewFileMetaDataFromConfig returns a FileMetaData struct associated with
+// one line in a legacy metadata file: the file name, the version and the
+// space separated hash list.
+func NewFileMetaDataFromConfig(configString string) (*FileMetaData, error) {
 	configItems := strings.Split(configString, CONFIG_DELIMITER)
+	if len(configItems) != HASH_LIST_INDEX+1 {
+		return nil, fmt.Errorf("malformed metadata line %q", configString)
+	}
 
 	filename := configItems[FILENAME_INDEX]
-	version, _ := strconv.Atoi(configItems[VERSION_INDEX])
-	blockHashList := strings.Split(configItems[HASH_LIST_INDEX], HASH_DELIMITER)
+	version, err := strconv.Atoi(configItems[VERSION_INDEX])
+	if err != nil {
+		return nil, fmt.Errorf("malformed version in metadata line %q: %v", configString, err)
+	}
 
-	return &FileMetaData{
+	fileMetaData := &FileMetaData{
 		Filename:      filename,
 		Version:       int32(version),
-		BlockHashList: blockHashList[:len(blockHashList)-1],
+		BlockHashList: strings.Fields(configItems[HASH_LIST_INDEX]),
 	}
+	MigrateTombstone(fileMetaData)
+	return fileMetaData, nil
 }
 
 // LoadMetaFromMetaFiles loads the local metadata file into a file meta map.
 // The key is the file's name and the value is the file's metadata.
 // You can use this function to load the index.txt file in this project.
 func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
+	fileMetaMap, _, e = LoadLocalIndex(baseDir)
+	return fileMetaMap, e
+}
+
+// LoadLocalIndex loads the local metadata file into a file meta map
+// and a map of the stat data recorded for each file. Metadata files in
+// the legacy comma separated format are read as well, and are migrated
+// the next time the index is written.
+func LoadLocalIndex(baseDir string) (fileMetaMap map[string]*FileMetaData, fileStatMap map[string]*LocalFileStat, e error) {
 	metaFilePath, _ := filepath.Abs(ConcatPath(baseDir, DEFAULT_META_FILENAME))
 
 	fileMetaMap = make(map[string]*FileMetaData)
+	fileStatMap = make(map[string]*LocalFileStat)
 
 	metaFileStats, e := os.Stat(metaFilePath)
 	if e != nil || metaFileStats.IsDir() {
-		return fileMetaMap, nil
+		return fileMetaMap, fileStatMap, nil
 	}
 	metaFD, e := os.Open(metaFilePath)
 	if e != nil {
-		log.Fatal("Error When Opening Meta")
+		return nil, nil, e
 	}
 	defer metaFD.Close()
 
-	leftOverContent := ""
 	metaReader := bufio.NewReader(metaFD)
-	for {
-		lineContent, isPrefix, e := metaReader.ReadLine()
-		if e != nil && e != io.EOF {
-			log.Fatal("Error During Reading Meta")
+	headerLine, e := metaReader.ReadBytes('\n')
+	if e != nil && e != io.EOF {
+		return nil, nil, e
+	}
+	var header localIndexHeader
+	if json.Unmarshal(headerLine, &header) != nil || header.Format != LOCAL_INDEX_FORMAT {
+		if _, e = metaFD.Seek(0, io.SeekStart); e != nil {
+			return nil, nil, e
 		}
+		e = loadLegacyLocalIndex(bufio.NewReader(metaFD), fileMetaMap)
+		return fileMetaMap, fileStatMap, e
+	}
+	if header.Version > LOCAL_INDEX_VERSION {
+		return nil, nil, fmt.Errorf("%v has index version %v, this client reads up to version %v", metaFilePath, header.Version, LOCAL_INDEX_VERSION)
+	}
 
-		leftOverContent += string(lineContent)
-		if isPrefix {
-			continue
+	decoder := json.NewDecoder(metaReader)
+	for {
+		var entry localIndexEntry
+		if e = decoder.Decode(&entry); e == io.EOF {
+			break
+		} else if e != nil {
+			return nil, nil, fmt.Errorf("malformed entry in %v: %v", metaFilePath, e)
 		}
+		fileMetaMap[entry.Filename] = &FileMetaData{
+			Filename:      entry.Filename,
+			Version:       entry.Version,
+			BlockHashList: entry.BlockHashList,
+			Mode:          entry.Mode,
+			Mtime:         entry.Mtime,
+			SymlinkTarget: entry.SymlinkTarget,
+			Size:          entry.Size,
+			Deleted:       entry.Deleted,
+			DeletedAt:     entry.DeletedAt,
+		}
+		if entry.Stat != nil {
+			fileStatMap[entry.Filename] = entry.Stat
+		}
+	}
 
-		if len(leftOverContent) == 0 {
-			break
+	return fileMetaMap, fileStatMap, nil
+}
+
+// loadLegacyLocalIndex reads a metadata file in the legacy comma separated
+// format, which records no stat data
+func loadLegacyLocalIndex(metaReader *bufio.Reader, fileMetaMap map[string]*FileMetaData) error {
+	for {
+		lineContent, e := metaReader.ReadString('\n')
+		if e != nil && e != io.EOF {
+			return e
 		}
 
-		currFileMeta := NewFileMetaDataFromConfig(leftOverContent)
+		line := strings.TrimRight(lineContent, "\r\n")
+		if len(line) > 0 {
+			currFileMeta, err := NewFileMetaDataFromConfig(line)
+			if err != nil {
+				return err
+			}
+			fileMetaMap[currFileMeta.Filename] = currFileMeta
+		}
 
-		leftOverContent = ""
-		fileMetaMap[currFileMeta.Filename] = currFileMeta
+		if e == io.EOF {
+			return nil
+		}
 	}
-
-	return fileMetaMap, nil
 }
 
 // FileMetaDataToString converts a FileMetaData struct
 // to a string for writing back to local metadata file
-func FileMetaDataToString(fm *FileMetaData) (result string) {
-	result += fm.Filename + ","
-	result += strconv.Itoa(int(fm.Version)) + ","
+func FileMetaDataToString(fm *FileMetaData) string {
+	return localIndexEntryToString(fm, nil)
+}
 
-	for _, blockHash := range fm.BlockHashList {
-		result += blockHash + " "
+// localIndexEntryToString converts a FileMetaData struct and the file's
+// stat data to a line of the local metadata file
+func localIndexEntryToString(fm *FileMetaData, stat *LocalFileStat) string {
+	blockHashList := fm.BlockHashList
+	if blockHashList == nil {
+		blockHashList = []string{}
 	}
+	line, _ := json.Marshal(&localIndexEntry{
+		Filename:      fm.Filename,
+		Version:       fm.Version,
+		BlockHashList: blockHashList,
+		Mode:          fm.Mode,
+		Mtime:         fm.Mtime,
+		SymlinkTarget: fm.SymlinkTarget,
+		Size:          fm.Size,
+		Deleted:       fm.Deleted,
+		DeletedAt:     fm.DeletedAt,
+		Stat:          stat,
+	})
+	return string(line) + "\n"
+}
 
-	result += "\n"
-	return
+// localIndexHeaderString returns the first line of the local metadata file
+func localIndexHeaderString() string {
+	line, _ := json.Marshal(&localIndexHeader{Format: LOCAL_INDEX_FORMAT, Version: LOCAL_INDEX_VERSION})
+	return string(line) + "\n"
 }
 
 // WriteMetaFile writes the file meta map back to local metadata file
 func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
+	return WriteLocalIndex(fileMetas, nil, baseDir)
+}
+
+// WriteLocalIndex writes the file meta map and the stat data of each file
+// back to local metadata file. Entries are sorted by file name. The index is
+// written to a temporary file which is synced and renamed over the old index,
+// so a crash leaves either the old or the new index behind.
+func WriteLocalIndex(fileMetas map[string]*FileMetaData, fileStats map[string]*LocalFileStat, baseDir string) error {
 	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
+	tempMetaPath := ConcatPath(baseDir, DEFAULT_META_TEMP_FILENAME)
 
-	outFD, err := os.Create(outputMetaPath)
-	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+	filenames := make([]string, 0, len(fileMetas))
+	for filename := range fileMetas {
+		filenames = append(filenames, filename)
 	}
+	sort.Strings(filenames)
 
-	for _, fileMeta := range fileMetas {
-		_, err := outFD.WriteString(FileMetaDataToString(fileMeta))
+	outFD, err := os.OpenFile(tempMetaPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	outWriter := bufio.NewWriter(outFD)
+	_, err = outWriter.WriteString(localIndexHeaderString())
+	for _, filename := range filenames {
 		if err != nil {
-			log.Fatal("Error During Meta Write Back")
+			break
 		}
+		_, err = outWriter.WriteString(localIndexEntryToString(fileMetas[filename], fileStats[filename]))
+	}
+	if err == nil {
+		err = outWriter.Flush()
+	}
+	if err == nil {
+		err = outFD.Sync()
+	}
+	if closeErr := outFD.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempMetaPath)
+		return fmt.Errorf("error writing %v: %v", tempMetaPath, err)
+	}
+
+	if err := os.Rename(tempMetaPath, outputMetaPath); err != nil {
+		os.Remove(tempMetaPath)
+		return err
 	}
+	return syncDir(baseDir)
+}
 
+// isMetaFile reports whether a base dir entry is the client's own metadata or
+// an unfinished download rather than a synced file
+func isMetaFile(name string) bool {
+	switch name {
+	case DEFAULT_META_FILENAME, DEFAULT_META_TEMP_FILENAME, DEFAULT_CURSOR_FILENAME, DEFAULT_CURSOR_TEMP_FILENAME:
+		return true
+	}
+	return strings.HasPrefix(name, DEFAULT_DOWNLOAD_TEMP_PREFIX)
+}
+
+// SyncCursor is the MetaStore change cursor the local index is current to.
+// It only applies to the index and ignore patterns it was written with, so
+// the index's hash and the patterns' fingerprint are recorded along with it.
+type SyncCursor struct {
+	Cursor string `json:"cursor"`
+	Index  string `json:"index"`
+	Ignore string `json:"ignore"`
+}
+
+// LoadSyncCursor reads the cursor file of a base dir. A missing or unreadable
+// cursor is returned empty, which makes the next sync fetch the full file map.
+func LoadSyncCursor(baseDir string) (*SyncCursor, error) {
+	cursor := &SyncCursor{}
+	data, err := os.ReadFile(ConcatPath(baseDir, DEFAULT_CURSOR_FILENAME))
+	if os.IsNotExist(err) {
+		return cursor, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return &SyncCursor{}, nil
+	}
+	return cursor, nil
+}
+
+// WriteSyncCursor atomically replaces the cursor file of a base dir
+func WriteSyncCursor(cursor *SyncCursor, baseDir string) error {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	tempCursorPath := ConcatPath(baseDir, DEFAULT_CURSOR_TEMP_FILENAME)
+	if err := os.WriteFile(tempCursorPath, append(data, '\n'), 0644); err != nil {
+		os.Remove(tempCursorPath)
+		return err
+	}
+	if err := os.Rename(tempCursorPath, ConcatPath(baseDir, DEFAULT_CURSOR_FILENAME)); err != nil {
+		os.Remove(tempCursorPath)
+		return err
+	}
+	return syncDir(baseDir)
+}
+
+// localIndexHash returns the hash of the local metadata file's contents, empty
+// if there is none
+func localIndexHash(baseDir string) (string, error) {
+	data, err := os.ReadFile(ConcatPath(baseDir, DEFAULT_META_FILENAME))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return GetBlockHashString(data), nil
+}
+
+// syncDir flushes a directory entry change such as a rename to disk
+func syncDir(dir string) error {
+	dirFD, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFD.Close()
+	if err := dirFD.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
 	return nil
 }
 
+// MigrateTombstone converts a deletion marked with the legacy "0" hash list
+// into an explicit tombstone. The deletion time of such files is unknown, so
+// their retention period starts now.
+func MigrateTombstone(fm *FileMetaData) {
+	if fm == nil || fm.Deleted {
+		return
+	}
+	if len(fm.BlockHashList) == 1 && fm.BlockHashList[0] == LEGACY_TOMBSTONE_HASH {
+		fm.Deleted = true
+		fm.DeletedAt = time.Now().UnixNano()
+		fm.BlockHashList = nil
+	}
+}
+
 /*
 	Debugging Related
 */
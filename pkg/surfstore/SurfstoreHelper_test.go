@@ -0,0 +1,45 @@
+package surfstore
+
+import (
+	"testing"
+)
+
+// TestNewFileMetaDataFromConfig reads lines of the legacy comma separated index
+func TestNewFileMetaDataFromConfig(t *testing.T) {
+	tests := []struct {
+		line string
+		want *FileMetaData
+	}{
+		{
+			line: "a.txt,3,h1 h2 ",
+			want: &FileMetaData{Filename: "a.txt", Version: 3, BlockHashList: []string{"h1", "h2"}},
+		},
+		{
+			line: "empty.txt,1,",
+			want: &FileMetaData{Filename: "empty.txt", Version: 1, BlockHashList: []string{}},
+		},
+		{
+			// deletions were marked with the "0" hash list
+			line: "gone,5,0 ",
+			want: &FileMetaData{Filename: "gone", Version: 5, BlockHashList: []string{}, Deleted: true},
+		},
+	}
+	for _, test := range tests {
+		got, err := NewFileMetaDataFromConfig(test.line)
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if got.GetFilename() != test.want.GetFilename() || got.GetVersion() != test.want.GetVersion() ||
+			GetHashString(got.GetBlockHashList()) != GetHashString(test.want.GetBlockHashList()) ||
+			got.GetDeleted() != test.want.GetDeleted() {
+			t.Errorf("%q: got %v, want %v", test.line, got, test.want)
+		}
+	}
+
+	for _, line := range []string{"a.txt", "a.txt,x,h1 ", "a.txt,1,h1 ,644"} {
+		if _, err := NewFileMetaDataFromConfig(line); err == nil {
+			t.Errorf("%q: malformed line was read", line)
+		}
+	}
+}
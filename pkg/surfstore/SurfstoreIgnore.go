@@ -0,0 +1,125 @@
+package surfstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type ignorePattern struct {
+	glob    string
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreMatcher decides which base dir entries are left out of a sync.
+// Patterns follow the gitignore syntax: blank lines and lines starting with
+// "#" are skipped, "!" negates a pattern, a trailing "/" only matches
+// directories and the last matching pattern wins.
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// NewIgnoreMatcher builds a matcher from gitignore-style pattern lines
+func NewIgnoreMatcher(lines []string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	if err := m.AddPatterns("-ignore", lines); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AddPatterns appends patterns, which take precedence over the ones already
+// added. A malformed pattern fails with an error naming the source and line.
+func (m *IgnoreMatcher) AddPatterns(source string, lines []string) error {
+	for i, raw := range lines {
+		line := strings.TrimRight(raw, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\") {
+			// "\#" and "\!" match names starting with those characters
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// the base dir is flat, so anchored and "**/" patterns match top level names
+		line = strings.TrimPrefix(line, "/")
+		line = strings.TrimPrefix(line, "**/")
+		if line == "" {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return fmt.Errorf("%v line %v: invalid pattern %q: %v", source, i+1, raw, err)
+		}
+		p.glob = line
+		m.patterns = append(m.patterns, p)
+	}
+	return nil
+}
+
+// Match reports whether the base dir entry name is ignored
+func (m *IgnoreMatcher) Match(name string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	ignored := false
+	for _, p := range m.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if ok, _ := filepath.Match(p.glob, name); ok {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// Fingerprint identifies the matcher's patterns, so a change of the ignore
+// rules can be told apart from an unchanged set
+func (m *IgnoreMatcher) Fingerprint() string {
+	var b strings.Builder
+	for _, p := range m.patterns {
+		fmt.Fprintf(&b, "%v %v %q\n", p.negate, p.dirOnly, p.glob)
+	}
+	return GetBlockHashString([]byte(b.String()))
+}
+
+// LoadIgnoreFile builds the matcher for a base dir. The global patterns are
+// applied first so the base dir's ignore file can override them.
+func LoadIgnoreFile(baseDir string, globalPatterns []string) (*IgnoreMatcher, error) {
+	m, err := NewIgnoreMatcher(globalPatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	ignoreFD, err := os.Open(ConcatPath(baseDir, DEFAULT_IGNORE_FILENAME))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer ignoreFD.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(ignoreFD)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := m.AddPatterns(DEFAULT_IGNORE_FILENAME, lines); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
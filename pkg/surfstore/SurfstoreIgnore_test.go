@@ -0,0 +1,86 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	m, err := NewIgnoreMatcher([]string{
+		"# editor files",
+		"*.swp",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/anchored",
+		"**/nested",
+		"\\#literal",
+		"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.swp", false, true},
+		{"debug.log", false, true},
+		// a later negation wins
+		{"keep.log", false, false},
+		// directory-only patterns skip files of the same name
+		{"build", true, true},
+		{"build", false, false},
+		{"anchored", false, true},
+		{"nested", false, true},
+		{"#literal", false, true},
+		{"# editor files", false, false},
+		{"notes.txt", false, false},
+	}
+	for _, test := range tests {
+		if got := m.Match(test.name, test.isDir); got != test.ignored {
+			t.Errorf("Match(%q, %v) = %v, want %v", test.name, test.isDir, got, test.ignored)
+		}
+	}
+
+	if _, err := NewIgnoreMatcher([]string{"ok", "[unclosed"}); err == nil {
+		t.Error("a malformed pattern was accepted")
+	}
+}
+
+// TestLoadIgnoreFile checks that the base dir's .surfignore overrides the
+// global patterns
+func TestLoadIgnoreFile(t *testing.T) {
+	baseDir := t.TempDir()
+	ignoreFile := "!important.tmp\nlocal-only\n"
+	if err := os.WriteFile(filepath.Join(baseDir, DEFAULT_IGNORE_FILENAME), []byte(ignoreFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadIgnoreFile(baseDir, []string{"*.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ignored := range map[string]bool{"scratch.tmp": true, "important.tmp": false, "local-only": true, "notes.txt": false} {
+		if got := m.Match(name, false); got != ignored {
+			t.Errorf("Match(%q) = %v, want %v", name, got, ignored)
+		}
+	}
+
+	// the fingerprint changes with the patterns
+	global, err := LoadIgnoreFile(t.TempDir(), []string{"*.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Fingerprint() == global.Fingerprint() {
+		t.Error("different patterns have the same fingerprint")
+	}
+
+	if err := os.WriteFile(filepath.Join(baseDir, DEFAULT_IGNORE_FILENAME), []byte("ok\n[bad\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIgnoreFile(baseDir, nil); err == nil {
+		t.Error("a malformed .surfignore was accepted")
+	}
+}
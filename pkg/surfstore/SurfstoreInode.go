@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package surfstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// getInode returns the inode number of a file, or 0 if the platform has none
+func getInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -10,11 +10,38 @@ type MetaStoreInterface interface {
 	// Retrieves the server's FileInfoMap
 	GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error)
 
-	// Update a file's fileinfo entry
-	UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error)
+	// Retrieve the fileinfo entries committed after a cursor and the next cursor
+	GetChangesSince(ctx context.Context, changeCursor *ChangeCursor) (*Changes, error)
+
+	// Retrieve one page of the fileinfo entries whose names start with a prefix
+	ListFiles(ctx context.Context, request *ListFilesRequest) (*FileList, error)
+
+	// Update a file's fileinfo entry if the server holds the expected version
+	UpdateFile(ctx context.Context, fileUpdate *FileUpdate) (*Version, error)
+
+	// Update several files' fileinfo entries atomically, or report the conflicts
+	UpdateFiles(ctx context.Context, fileUpdates *FileUpdates) (*FileUpdateResult, error)
+
+	// Move a file's fileinfo entry to a new name, keeping its version history
+	RenameFile(ctx context.Context, fileRename *FileRename) (*FileInfoMap, error)
 
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Get the addresses of all BlockStores
+	GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error)
+
+	// Get the logical size and number of files and the quotas
+	GetUsage(ctx context.Context, _ *emptypb.Empty) (*Usage, error)
+
+	// Freeze a copy of the FileInfoMap under a name
+	CreateSnapshot(ctx context.Context, snapshotName *SnapshotName) (*Snapshot, error)
+
+	// List the snapshots without their files
+	ListSnapshots(ctx context.Context, _ *emptypb.Empty) (*Snapshots, error)
+
+	// Retrieve a snapshot with its files
+	GetSnapshot(ctx context.Context, snapshotName *SnapshotName) (*Snapshot, error)
 }
 
 type BlockStoreInterface interface {
@@ -28,13 +55,37 @@ type BlockStoreInterface interface {
 	// Given a list of hashes “in”, returns a list containing the
 	// subset of in that are stored in the key-value store
 	HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
+
+	// Store one erasure-coded shard of a block
+	PutShard(ctx context.Context, shard *Shard) (*Success, error)
+
+	// Get the shards of a block held by this BlockStore
+	GetShards(ctx context.Context, blockHash *BlockHash) (*Shards, error)
+
+	// Get the hit and miss counters of the block cache
+	GetCacheStats(ctx context.Context, _ *emptypb.Empty) (*CacheStats, error)
+
+	// Get the sizes of the blocks held by this BlockStore
+	GetBlockSizes(ctx context.Context, blockHashes *BlockHashes) (*BlockSizes, error)
+
+	// Delete blocks held by this BlockStore
+	DeleteBlocks(ctx context.Context, blockHashes *BlockHashes) (*Success, error)
 }
 
 type ClientInterface interface {
 	// MetaStore
 	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
-	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
+	GetChangesSince(cursor string, changes *Changes) error
+	ListFiles(request *ListFilesRequest, fileList *FileList) error
+	UpdateFile(fileUpdate *FileUpdate, latestVersion *int32) error
+	UpdateFiles(fileUpdates []*FileUpdate, conflicts *[]*FileConflict) error
+	RenameFile(oldFilename string, newFilename string, expectedVersion int32, fileMetas *map[string]*FileMetaData) error
 	GetBlockStoreAddr(blockStoreAddr *string) error
+	GetBlockStoreAddrs(blockStoreAddrs *BlockStoreAddrs) error
+	GetUsage(usage *Usage) error
+	CreateSnapshot(name string, snapshot *Snapshot) error
+	ListSnapshots(snapshots *[]*Snapshot) error
+	GetSnapshot(name string, snapshot *Snapshot) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
@@ -2,9 +2,14 @@ package surfstore
 
 import (
 	context "context"
+	"crypto/tls"
 	"time"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
@@ -16,6 +21,46 @@ type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+
+	// DryRun only reports the planned action of each file
+	DryRun bool
+	// IgnorePatterns are gitignore-style patterns applied before the base dir's .surfignore
+	IgnorePatterns []string
+	// PreserveMetadata syncs mode bits, mtimes and symlinks instead of only file contents
+	PreserveMetadata bool
+	// Rehash hashes every file instead of trusting unchanged stat data in the index
+	Rehash bool
+	// Parallelism is the number of blocks transferred at once
+	Parallelism int
+	// MaxInFlightBytes caps the memory used by blocks being transferred
+	MaxInFlightBytes int
+	// DialOptions are added to every connection to the servers, for example
+	// TLS credentials or a dialer reaching servers in the same process
+	DialOptions []grpc.DialOption
+}
+
+func (surfClient *RPCClient) dialOptions() []grpc.DialOption {
+	return withDefaultDialOptions(surfClient.DialOptions)
+}
+
+// withDefaultDialOptions puts the given options after the defaults, so
+// connections are insecure unless the options set transport credentials
+func withDefaultDialOptions(opts []grpc.DialOption) []grpc.DialOption {
+	return append([]grpc.DialOption{grpc.WithInsecure()}, opts...)
+}
+
+// NewTLSDialOption returns the option for connecting to servers that listen
+// with TLS. Their certificates are verified against the CA certificates in
+// the PEM file caFile, or against the system's roots if caFile is empty.
+func NewTLSDialOption(caFile string) (grpc.DialOption, error) {
+	if caFile == "" {
+		return grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})), nil
+	}
+	creds, err := credentials.NewClientTLSFromFile(caFile, "")
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(creds), nil
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
@@ -23,7 +68,7 @@ func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, b
 	// defer blockLock.Unlock()
 
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := grpc.Dial(blockStoreAddr, surfClient.dialOptions()...)
 	if err != nil {
 		return err
 	}
@@ -49,7 +94,7 @@ func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ
 	// defer blockLock.Unlock()
 
 	// log.Printf("block store addr: %v\n", blockStoreAddr)
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := grpc.Dial(blockStoreAddr, surfClient.dialOptions()...)
 	if err != nil {
 		return err
 	}
@@ -70,7 +115,7 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr st
 	// blockLock.Lock()
 	// defer blockLock.Unlock()
 
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := grpc.Dial(blockStoreAddr, surfClient.dialOptions()...)
 	if err != nil {
 		return err
 	}
@@ -91,7 +136,7 @@ func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileM
 	// metaLock.Lock()
 	// defer metaLock.Unlock()
 
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
 	if err != nil {
 		return err
 	}
@@ -108,10 +153,46 @@ func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileM
 	return conn.Close()
 }
 
-func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
+func (surfClient *RPCClient) GetChangesSince(cursor string, changes *Changes) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := ms.GetChangesSince(ctx, &ChangeCursor{Cursor: cursor})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Merge(changes, res)
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) ListFiles(request *ListFilesRequest, fileList *FileList) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err := ms.ListFiles(ctx, request)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Merge(fileList, res)
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) UpdateFile(fileUpdate *FileUpdate, latestVersion *int32) error {
 	// metaLock.Lock()
 	// defer metaLock.Unlock()
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
 	if err != nil {
 		return err
 	}
@@ -120,7 +201,7 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
 	// perform the call
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	version, err := ms.UpdateFile(ctx, fileMetaData)
+	version, err := ms.UpdateFile(ctx, fileUpdate)
 	if err != nil {
 		conn.Close()
 		return err
@@ -132,6 +213,52 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
 	return conn.Close()
 }
 
+func (surfClient *RPCClient) UpdateFiles(fileUpdates []*FileUpdate, conflicts *[]*FileConflict) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := ms.UpdateFiles(ctx, &FileUpdates{Updates: fileUpdates})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*conflicts = result.GetConflicts()
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) RenameFile(oldFilename string, newFilename string, expectedVersion int32, fileMetas *map[string]*FileMetaData) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := ms.RenameFile(ctx, &FileRename{
+		OldFilename:     oldFilename,
+		NewFilename:     newFilename,
+		ExpectedVersion: expectedVersion,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*fileMetas = result.GetFileInfoMap()
+
+	// close the connection
+	return conn.Close()
+}
+
 func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
 	// metaLock.Lock()
 	// defer metaLock.Unlock()
@@ -139,7 +266,7 @@ func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
 	// log.Printf("meta store addr: %v\n", surfClient.MetaStoreAddr)
 
 	// connect to the server
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
 	if err != nil {
 		return err
 	}
@@ -160,6 +287,126 @@ func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
 	return conn.Close()
 }
 
+func (surfClient *RPCClient) GetBlockStoreAddrs(blockStoreAddrs *BlockStoreAddrs) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	addrs, err := ms.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Merge(blockStoreAddrs, addrs)
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetUsage(usage *Usage) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	u, err := ms.GetUsage(ctx, &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Merge(usage, u)
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) CreateSnapshot(name string, snapshot *Snapshot) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := ms.CreateSnapshot(ctx, &SnapshotName{Name: name})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Merge(snapshot, s)
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) ListSnapshots(snapshots *[]*Snapshot) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := ms.ListSnapshots(ctx, &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*snapshots = s.GetSnapshots()
+
+	// close the connection
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetSnapshot(name string, snapshot *Snapshot) error {
+	conn, err := grpc.Dial(surfClient.MetaStoreAddr, surfClient.dialOptions()...)
+	if err != nil {
+		return err
+	}
+	ms := NewMetaStoreClient(conn)
+
+	// perform the call
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := ms.GetSnapshot(ctx, &SnapshotName{Name: name})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Merge(snapshot, s)
+
+	// close the connection
+	return conn.Close()
+}
+
+// GetConflict returns the conflict carried by an error from UpdateFile,
+// or nil if the error is not a version conflict
+func GetConflict(err error) *FileConflict {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Aborted {
+		return nil
+	}
+	for _, detail := range st.Details() {
+		if conflict, ok := detail.(*FileConflict); ok {
+			return conflict
+		}
+	}
+	return nil
+}
+
 // This line guarantees all method for RPCClient are implemented
 var _ ClientInterface = new(RPCClient)
 
@@ -0,0 +1,323 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Rebalancer moves blocks to their new owners after BlockStores joined or
+// left. Only blocks whose owners differ between From and To are copied, and
+// owners that already hold a block are skipped with HasBlocks, so a rerun
+// only copies what is still missing. Once the new owners hold a block, its
+// previous owners that lost it delete their copies if the Rebalancer has their
+// admin token. Erasure-coded blocks cannot be rebalanced.
+type Rebalancer struct {
+	// From are the BlockStore addresses before the change, To after it
+	From []string
+	To   []string
+	// ReplicationFactor is the number of owners of each block
+	ReplicationFactor int
+	// BlocksPerSecond throttles the copies, 0 is unlimited
+	BlocksPerSecond int
+	// StateFile records the last rebalanced hash, so an interrupted run
+	// resumes after it. It is removed once a run completes.
+	StateFile string
+	// DialOptions are added to the options BlockStores are dialed with, for
+	// example TLS credentials
+	DialOptions []grpc.DialOption
+	// AdminToken authorizes deleting moved blocks from their previous
+	// owners. Without it the previous owners keep their copies.
+	AdminToken string
+}
+
+func (rb *Rebalancer) dialOptions() []grpc.DialOption {
+	return withDefaultDialOptions(rb.DialOptions)
+}
+
+// topOwners returns the first r BlockStores in a block's ranking
+func topOwners(hash string, addrs []string, r int) []string {
+	ranking := BlockOwners(hash, addrs)
+	if r < 1 {
+		r = 1
+	}
+	if r > len(ranking) {
+		r = len(ranking)
+	}
+	return ranking[:r]
+}
+
+// Run copies the given blocks to their new owners in hash order, deletes
+// them from the previous owners that lost them and returns the number of
+// copies made. Blocks that cannot be read from any BlockStore are logged and
+// skipped, and kept on their previous owners. A previous owner that cannot be
+// reached, for example one that left, is logged and skipped too. A cancelled ctx stops the run after the current
+// block, and the next run resumes from the state file.
+func (rb *Rebalancer) Run(ctx context.Context, hashes []string) (int, error) {
+	sorted := append([]string(nil), hashes...)
+	sort.Strings(sorted)
+	cursor, err := rb.loadCursor()
+	if err != nil {
+		return 0, err
+	}
+	if cursor != "" {
+		log.Printf("resuming rebalance after %v\n", cursor)
+		sorted = sorted[sort.SearchStrings(sorted, cursor):]
+		if len(sorted) > 0 && sorted[0] == cursor {
+			sorted = sorted[1:]
+		}
+	}
+
+	var throttle <-chan time.Time
+	if rb.BlocksPerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rb.BlocksPerSecond))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	copied := 0
+	for start := 0; start < len(sorted); start += HAS_BLOCKS_BATCH_SIZE {
+		if ctx.Err() != nil {
+			return copied, ctx.Err()
+		}
+		end := start + HAS_BLOCKS_BATCH_SIZE
+		if end > len(sorted) {
+			end = len(sorted)
+		}
+		batch := sorted[start:end]
+
+		// new owners that were not owners before, and previous owners that
+		// are no longer owners, by address
+		moves := make(map[string][]string)
+		drops := make(map[string][]string)
+		for _, hash := range batch {
+			oldOwners := make(map[string]bool)
+			for _, addr := range topOwners(hash, rb.From, rb.ReplicationFactor) {
+				oldOwners[addr] = true
+			}
+			newOwners := make(map[string]bool)
+			for _, addr := range topOwners(hash, rb.To, rb.ReplicationFactor) {
+				newOwners[addr] = true
+				if !oldOwners[addr] {
+					moves[addr] = append(moves[addr], hash)
+				}
+			}
+			for addr := range oldOwners {
+				if !newOwners[addr] {
+					drops[addr] = append(drops[addr], hash)
+				}
+			}
+		}
+
+		unreadable := make(map[string]bool)
+		for _, addr := range sortedAddrs(moves) {
+			held, err := hasBlocksAt(addr, moves[addr], rb.dialOptions())
+			if err != nil {
+				return copied, fmt.Errorf("BlockStore %v is unreachable: %v", addr, err)
+			}
+			for _, hash := range moves[addr] {
+				if held[hash] {
+					continue
+				}
+				block, err := rb.readBlock(hash)
+				if err != nil {
+					log.Printf("block %v cannot be read: %v\n", hash, err)
+					unreadable[hash] = true
+					continue
+				}
+				if throttle != nil {
+					select {
+					case <-ctx.Done():
+					case <-throttle:
+					}
+				}
+				if ctx.Err() != nil {
+					return copied, ctx.Err()
+				}
+				if err := putReplica(addr, block, rb.dialOptions()); err != nil {
+					return copied, fmt.Errorf("copying %v to %v failed: %v", hash, addr, err)
+				}
+				copied++
+			}
+		}
+
+		// every new owner holds the batch's blocks now, except unreadable ones,
+		// and the previous owners delete them given their admin token
+		if rb.AdminToken != "" {
+			for _, addr := range sortedAddrs(drops) {
+				hashes := make([]string, 0, len(drops[addr]))
+				for _, hash := range drops[addr] {
+					if !unreadable[hash] {
+						hashes = append(hashes, hash)
+					}
+				}
+				if err := deleteBlocksAt(addr, hashes, rb.AdminToken, rb.dialOptions()); err != nil {
+					log.Printf("deleting %v moved blocks from %v failed: %v\n", len(hashes), addr, err)
+				}
+			}
+		}
+
+		if err := rb.saveCursor(batch[len(batch)-1]); err != nil {
+			return copied, err
+		}
+	}
+
+	if rb.StateFile != "" {
+		if err := os.Remove(rb.StateFile); err != nil && !os.IsNotExist(err) {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// sortedAddrs returns the addresses of a map from BlockStores to hashes in order
+func sortedAddrs(hashesByAddr map[string][]string) []string {
+	addrs := make([]string, 0, len(hashesByAddr))
+	for addr := range hashesByAddr {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// readBlock fetches a block from its previous owners first, then from any
+// other BlockStore
+func (rb *Rebalancer) readBlock(hash string) (*Block, error) {
+	addrs := BlockOwners(hash, rb.From)
+	tried := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		tried[addr] = true
+	}
+	for _, addr := range BlockOwners(hash, rb.To) {
+		if !tried[addr] {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	err := fmt.Errorf("no BlockStores")
+	for _, addr := range addrs {
+		var block *Block
+		if block, err = getBlockAt(addr, hash, rb.dialOptions()); err == nil {
+			return block, nil
+		}
+	}
+	return nil, err
+}
+
+func (rb *Rebalancer) loadCursor() (string, error) {
+	if rb.StateFile == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(rb.StateFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// saveCursor atomically replaces the state file with the last rebalanced hash
+func (rb *Rebalancer) saveCursor(hash string) error {
+	if rb.StateFile == "" {
+		return nil
+	}
+	tempFile := rb.StateFile + ".tmp"
+	if err := os.WriteFile(tempFile, []byte(hash+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, rb.StateFile); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(rb.StateFile))
+}
+
+// StartRebalancing moves the referenced blocks from the previous to the
+// current BlockStores in the background, retrying every interval until a run
+// completes or ctx is cancelled. A completed run clears the previous
+// BlockStores, so clients stop reading from them. The returned channel is
+// closed once rebalancing stopped.
+func (m *MetaStore) StartRebalancing(ctx context.Context, interval time.Duration, rb *Rebalancer) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			hashes := make([]string, 0)
+			for hash := range m.ReferencedBlockHashes() {
+				hashes = append(hashes, hash)
+			}
+			copied, err := rb.Run(ctx, hashes)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				log.Printf("rebalanced %v blocks, rebalancing completed\n", copied)
+				m.mu.Lock()
+				m.PreviousBlockStoreAddrs = nil
+				m.mu.Unlock()
+				return
+			}
+			log.Printf("rebalance stopped after %v blocks: %v\n", copied, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return done
+}
+
+// FetchReferencedBlockHashes returns the hashes of every block referenced by
+// the MetaStore's files or snapshots
+func FetchReferencedBlockHashes(client RPCClient) ([]string, error) {
+	hashes := make(map[string]bool)
+	addHashes := func(fileMetaData *FileMetaData) error {
+		for _, hash := range fileMetaData.GetBlockHashList() {
+			hashes[hash] = true
+		}
+		return nil
+	}
+
+	if _, err := WalkFiles(client, "", false, addHashes); err != nil {
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	if err := client.ListSnapshots(&snapshots); err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if err := WalkSnapshotFiles(client, snapshot.GetName(), addHashes); err != nil {
+			return nil, err
+		}
+	}
+
+	list := make([]string, 0, len(hashes))
+	for hash := range hashes {
+		list = append(list, hash)
+	}
+	return list, nil
+}
+
+// getBlockAt fetches a block from a BlockStore
+func getBlockAt(addr string, hash string, opts []grpc.DialOption) (*Block, error) {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.GetBlock(ctx, &BlockHash{Hash: hash})
+}
@@ -0,0 +1,184 @@
+package surfstore
+
+import (
+	"log"
+	"os"
+	"sort"
+)
+
+// renameKey identifies file contents for rename detection, a renamed file
+// keeps its hash list and symlink target
+func renameKey(fmd *FileMetaData) string {
+	return GetHashString(fmd.GetBlockHashList()) + "\x00" + fmd.GetSymlinkTarget()
+}
+
+// detectRenames pairs files that vanished from the base dir with new or
+// revived files holding identical contents, and returns the old name of each
+// renamed file by its new name. Names are paired in sorted order so the result
+// is stable.
+func detectRenames(vanished map[string]*FileMetaData, localFileInfoMap map[string]*FileMetaData, fileNew map[string]bool, fileRevived map[string]bool) map[string]string {
+	candidates := make(map[string][]string)
+	oldNames := make([]string, 0, len(vanished))
+	for filename := range vanished {
+		oldNames = append(oldNames, filename)
+	}
+	sort.Strings(oldNames)
+	for _, filename := range oldNames {
+		key := renameKey(vanished[filename])
+		candidates[key] = append(candidates[key], filename)
+	}
+
+	newNames := make([]string, 0, len(fileNew)+len(fileRevived))
+	for filename := range fileNew {
+		newNames = append(newNames, filename)
+	}
+	for filename := range fileRevived {
+		newNames = append(newNames, filename)
+	}
+	sort.Strings(newNames)
+
+	renames := make(map[string]string)
+	for _, filename := range newNames {
+		key := renameKey(localFileInfoMap[filename])
+		if len(candidates[key]) == 0 {
+			continue
+		}
+		renames[filename] = candidates[key][0]
+		candidates[key] = candidates[key][1:]
+	}
+	return renames
+}
+
+// renameAllowed reports whether the server can rename a file: it must hold the
+// version of the old file the client last synced, and the new name must be free
+// or deleted
+func renameAllowed(oldMD *FileMetaData, serverOld *FileMetaData, serverNew *FileMetaData) bool {
+	if serverOld == nil || isDeleted(serverOld) || serverOld.GetVersion() != oldMD.GetVersion() {
+		return false
+	}
+	return serverNew == nil || isDeleted(serverNew)
+}
+
+// planRenames returns the detected renames the server would accept, by new name
+func planRenames(renames map[string]string, vanished map[string]*FileMetaData, serverFileInfoMap map[string]*FileMetaData) map[string]string {
+	planned := make(map[string]string)
+	for newName, oldName := range renames {
+		if renameAllowed(vanished[oldName], serverFileInfoMap[oldName], serverFileInfoMap[newName]) {
+			planned[newName] = oldName
+		}
+	}
+	return planned
+}
+
+// commitRenames moves the server entries of locally renamed files with
+// RenameFile, so the files keep their history instead of being deleted and
+// uploaded again. Renames the server rejects fall back to a deletion and an
+// upload; if another client changed the old file meanwhile, its current entry
+// from the conflict is used instead.
+func commitRenames(client RPCClient, renames map[string]string, vanished map[string]*FileMetaData, localFileInfoMap map[string]*FileMetaData, serverFileInfoMap map[string]*FileMetaData, fileModified map[string]bool, fileNew map[string]bool) {
+	for newName, oldName := range renames {
+		oldMD := vanished[oldName]
+		if !renameAllowed(oldMD, serverFileInfoMap[oldName], serverFileInfoMap[newName]) {
+			continue
+		}
+
+		moved := make(map[string]*FileMetaData)
+		if err := client.RenameFile(oldName, newName, oldMD.GetVersion(), &moved); err != nil {
+			log.Printf("Fail to rename %v to %v: %v\n", oldName, newName, err)
+			if conflict := GetConflict(err); conflict != nil && conflict.GetCurrent() != nil {
+				serverFileInfoMap[oldName] = conflict.GetCurrent()
+			}
+			continue
+		}
+		log.Printf("Renamed %v to %v\n", oldName, newName)
+		serverFileInfoMap[oldName] = moved[oldName]
+		serverFileInfoMap[newName] = moved[newName]
+
+		localFileInfoMap[oldName] = moved[oldName]
+		delete(fileModified, oldName)
+		delete(fileModified, newName)
+		delete(fileNew, newName)
+		// metadata changed along with the name is uploaded as a new version
+		currMD := localFileInfoMap[newName]
+		if localFileChanged(moved[newName], currMD, client.PreserveMetadata) {
+			currMD.Version = moved[newName].GetVersion()
+			fileModified[newName] = true
+		} else {
+			localFileInfoMap[newName] = moved[newName]
+		}
+	}
+}
+
+// applyRenames carries out renames made by other clients. A download that
+// deletes a local file and a download that creates a missing file with the
+// same contents are applied with os.Rename. The remaining downloads are
+// returned.
+func applyRenames(client RPCClient, downloads []*FileMetaData, localFileInfoMap map[string]*FileMetaData) ([]*FileMetaData, error) {
+	// local files the server deleted, by contents
+	deletedFiles := make(map[string][]string)
+	for _, serverMD := range downloads {
+		localMD := localFileInfoMap[serverMD.GetFilename()]
+		if !isDeleted(serverMD) || localMD == nil || isDeleted(localMD) {
+			continue
+		}
+		key := renameKey(localMD)
+		deletedFiles[key] = append(deletedFiles[key], serverMD.GetFilename())
+	}
+	if len(deletedFiles) == 0 {
+		return downloads, nil
+	}
+	for _, filenames := range deletedFiles {
+		sort.Strings(filenames)
+	}
+
+	applied := make(map[string]bool)
+	for _, serverMD := range downloads {
+		if isDeleted(serverMD) {
+			continue
+		}
+		key := renameKey(serverMD)
+		if len(deletedFiles[key]) == 0 {
+			continue
+		}
+		newPath := ConcatPath(client.BaseDir, serverMD.GetFilename())
+		if _, err := os.Lstat(newPath); err == nil {
+			continue
+		}
+		oldName := deletedFiles[key][0]
+		deletedFiles[key] = deletedFiles[key][1:]
+
+		log.Printf("Renaming %v to %v...\n", oldName, serverMD.GetFilename())
+		if err := os.Rename(ConcatPath(client.BaseDir, oldName), newPath); err != nil {
+			return nil, err
+		}
+		fmd := &FileMetaData{
+			Filename:      serverMD.GetFilename(),
+			Version:       serverMD.GetVersion(),
+			BlockHashList: serverMD.GetBlockHashList(),
+			Mode:          serverMD.GetMode(),
+			Mtime:         serverMD.GetMtime(),
+			SymlinkTarget: serverMD.GetSymlinkTarget(),
+			Size:          serverMD.GetSize(),
+		}
+		if client.PreserveMetadata && fmd.GetSymlinkTarget() == "" {
+			if err := applyFileMetadata(newPath, fmd); err != nil {
+				return nil, err
+			}
+		}
+		localFileInfoMap[fmd.GetFilename()] = fmd
+		applied[fmd.GetFilename()] = true
+		applied[oldName] = true
+	}
+
+	remaining := make([]*FileMetaData, 0, len(downloads))
+	for _, serverMD := range downloads {
+		if applied[serverMD.GetFilename()] {
+			if isDeleted(serverMD) {
+				localFileInfoMap[serverMD.GetFilename()] = serverMD
+			}
+			continue
+		}
+		remaining = append(remaining, serverMD)
+	}
+	return remaining, nil
+}
@@ -0,0 +1,326 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/subtle"
+	"log"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// BlockOwners ranks the BlockStores for a block with rendezvous hashing. The
+// first ReplicationFactor addresses own the block, the rest are fallbacks in
+// order. Every client and server computes the same ranking.
+func BlockOwners(hash string, addrs []string) []string {
+	scores := make(map[string]string, len(addrs))
+	for _, addr := range addrs {
+		scores[addr] = GetBlockHashString([]byte(addr + "/" + hash))
+	}
+	ranking := append([]string(nil), addrs...)
+	sort.Slice(ranking, func(i, j int) bool {
+		if scores[ranking[i]] != scores[ranking[j]] {
+			return scores[ranking[i]] > scores[ranking[j]]
+		}
+		return ranking[i] < ranking[j]
+	})
+	return ranking
+}
+
+// replicationFactor is the number of copies kept of each block
+func (bs *BlockStore) replicationFactor() int {
+	r := bs.ReplicationFactor
+	if r < 1 {
+		r = 1
+	}
+	if r > len(bs.Peers) {
+		r = len(bs.Peers)
+	}
+	return r
+}
+
+// isReplicaWrite reports whether a PutBlock call comes from another BlockStore
+// copying a block, which must not be replicated again
+func isReplicaWrite(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(REPLICA_METADATA_KEY)) > 0
+}
+
+// isAdminCall reports whether a call carries the admin token. Without a token
+// no call is an admin call.
+func isAdminCall(ctx context.Context, adminToken string) bool {
+	if adminToken == "" {
+		return false
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, token := range md.Get(ADMIN_TOKEN_METADATA_KEY) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsBlock reports whether this BlockStore is one of a block's owners among
+// its peers
+func (bs *BlockStore) ownsBlock(hash string) bool {
+	if len(bs.Peers) < 2 {
+		return false
+	}
+	for _, addr := range topOwners(hash, bs.Peers, bs.replicationFactor()) {
+		if addr == bs.Self {
+			return true
+		}
+	}
+	return false
+}
+
+// putReplicated stores a block on its owners and returns once a quorum of them
+// acknowledged it. Owners that fail are replaced by the next BlockStores in
+// the block's ranking, the remaining writes finish in the background.
+func (bs *BlockStore) putReplicated(block *Block) (*Success, error) {
+	hash := GetBlockHashString(block.GetBlockData())
+	ranking := BlockOwners(hash, bs.Peers)
+	r := bs.replicationFactor()
+	quorum := r/2 + 1
+
+	results := make(chan error, len(ranking))
+	write := func(addr string) {
+		if addr == bs.Self {
+			results <- bs.storeBlock(block)
+			return
+		}
+		results <- putReplica(addr, block, bs.dialOptions())
+	}
+	for _, addr := range ranking[:r] {
+		go write(addr)
+	}
+
+	next, pending, acks := r, r, 0
+	for acks < quorum && pending > 0 {
+		err := <-results
+		pending--
+		if err == nil {
+			acks++
+			continue
+		}
+		log.Printf("replica write of %v failed: %v\n", hash, err)
+		if next < len(ranking) {
+			go write(ranking[next])
+			next++
+			pending++
+		}
+	}
+	if acks < quorum {
+		return nil, status.Errorf(codes.Unavailable, "block %v stored on %v BlockStores, quorum is %v", hash, acks, quorum)
+	}
+	return &Success{Flag: true}, nil
+}
+
+// ReplicateBlocks restores the replica count of every local block. Each block
+// is copied to its highest ranked reachable BlockStores until ReplicationFactor
+// of them hold it, so a lost node's copies move to the next BlockStores in the
+// ranking. It returns the number of copies made, and stops early once ctx is
+// cancelled.
+func (bs *BlockStore) ReplicateBlocks(ctx context.Context) int {
+	if len(bs.Peers) < 2 {
+		return 0
+	}
+	hashes, err := bs.blockHashes()
+	if err != nil {
+		log.Printf("listing blocks failed: %v\n", err)
+		return 0
+	}
+
+	// which peers are up and which blocks they hold
+	reachable := make(map[string]bool)
+	holds := make(map[string]map[string]bool)
+	for _, addr := range bs.Peers {
+		if addr == bs.Self {
+			continue
+		}
+		held, err := hasBlocksAt(addr, hashes, bs.dialOptions())
+		if err != nil {
+			log.Printf("BlockStore %v is unreachable: %v\n", addr, err)
+			continue
+		}
+		reachable[addr] = true
+		holds[addr] = held
+	}
+
+	copied := 0
+	r := bs.replicationFactor()
+	for _, hash := range hashes {
+		if ctx.Err() != nil {
+			break
+		}
+		count := 0
+		for _, addr := range BlockOwners(hash, bs.Peers) {
+			if count == r {
+				break
+			}
+			if addr == bs.Self || holds[addr][hash] {
+				count++
+				continue
+			}
+			if !reachable[addr] {
+				continue
+			}
+			block, ok, err := bs.lookupBlock(hash)
+			if err != nil || !ok {
+				break
+			}
+			if err := putReplica(addr, block, bs.dialOptions()); err != nil {
+				log.Printf("copying %v to %v failed: %v\n", hash, addr, err)
+				continue
+			}
+			copied++
+			count++
+		}
+	}
+	return copied
+}
+
+// StartReplication runs ReplicateBlocks every interval in the background
+// until ctx is cancelled. The returned channel is closed once it stopped.
+func (bs *BlockStore) StartReplication(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if copied := bs.ReplicateBlocks(ctx); copied > 0 {
+				log.Printf("re-replicated %v blocks\n", copied)
+			}
+		}
+	}()
+	return done
+}
+
+// putReplica stores a block on another BlockStore without replicating it further
+func putReplica(addr string, block *Block, opts []grpc.DialOption) error {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, REPLICA_METADATA_KEY, "true")
+	_, err = c.PutBlock(ctx, block)
+	return err
+}
+
+// hasBlocksAt returns which of the hashes another BlockStore holds. Hashes
+// are sent in batches to keep messages small.
+func hasBlocksAt(addr string, hashes []string, opts []grpc.DialOption) (map[string]bool, error) {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	held := make(map[string]bool)
+	for start := 0; start < len(hashes); start += HAS_BLOCKS_BATCH_SIZE {
+		end := start + HAS_BLOCKS_BATCH_SIZE
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		found, err := c.HasBlocks(ctx, &BlockHashes{Hashes: hashes[start:end]})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range found.GetHashes() {
+			held[hash] = true
+		}
+	}
+	return held, nil
+}
+
+// blockSizesAt returns the sizes of the blocks among the hashes that another
+// BlockStore holds. Hashes are sent in batches to keep messages small.
+func blockSizesAt(addr string, hashes []string, opts []grpc.DialOption) (map[string]int64, error) {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	sizes := make(map[string]int64)
+	for start := 0; start < len(hashes); start += HAS_BLOCKS_BATCH_SIZE {
+		end := start + HAS_BLOCKS_BATCH_SIZE
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		found, err := c.GetBlockSizes(ctx, &BlockHashes{Hashes: hashes[start:end]})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for hash, size := range found.GetSizes() {
+			sizes[hash] = int64(size)
+		}
+	}
+	return sizes, nil
+}
+
+// deleteBlocksAt removes blocks from another BlockStore, authorized by its
+// admin token. Hashes are sent in batches to keep messages small.
+func deleteBlocksAt(addr string, hashes []string, adminToken string, opts []grpc.DialOption) error {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	for start := 0; start < len(hashes); start += HAS_BLOCKS_BATCH_SIZE {
+		end := start + HAS_BLOCKS_BATCH_SIZE
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ctx = metadata.AppendToOutgoingContext(ctx, ADMIN_TOKEN_METADATA_KEY, adminToken)
+		_, err := c.DeleteBlocks(ctx, &BlockHashes{Hashes: hashes[start:end]})
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pingBlockStore calls a BlockStore once to check that it is reachable
+func pingBlockStore(addr string, opts []grpc.DialOption) error {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := NewBlockStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = c.HasBlocks(ctx, &BlockHashes{})
+	return err
+}
@@ -0,0 +1,433 @@
+package surfstore
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	sync "sync"
+	"sync/atomic"
+)
+
+// blockTransferPool moves blocks between the base dir and the BlockStore on a
+// fixed number of workers. Every block that is read or fetched holds an
+// in-flight token until it is stored or written to its file, which caps the
+// memory used by in-flight blocks.
+type blockTransferPool struct {
+	client          RPCClient
+	blockStoreAddrs []string
+	// previousAddrs are the BlockStores before a rebalance, read after the current owners
+	previousAddrs []string
+	jobs          chan func()
+	inFlight      chan struct{}
+	workers       sync.WaitGroup
+
+	// blocks of local files which downloads copy instead of fetching
+	localBlocks  map[string]localBlock
+	sourceNames  map[string]bool
+	sourcesMu    sync.Mutex
+	sources      map[string]*os.File
+	reusedBlocks int64
+}
+
+// localBlock is where a block was found in the base dir when it was last indexed
+type localBlock struct {
+	filename string
+	offset   int64
+}
+
+func newBlockTransferPool(client RPCClient, blockStoreAddrs *BlockStoreAddrs) *blockTransferPool {
+	parallelism := client.Parallelism
+	if parallelism < 1 {
+		parallelism = DEFAULT_PARALLELISM
+	}
+	maxInFlightBytes := client.MaxInFlightBytes
+	if maxInFlightBytes < 1 {
+		maxInFlightBytes = DEFAULT_MAX_IN_FLIGHT_BYTES
+	}
+	maxInFlightBlocks := maxInFlightBytes / client.BlockSize
+	if maxInFlightBlocks < 1 {
+		maxInFlightBlocks = 1
+	}
+
+	p := &blockTransferPool{
+		client:          client,
+		blockStoreAddrs: blockStoreAddrs.GetAddrs(),
+		previousAddrs:   blockStoreAddrs.GetPreviousAddrs(),
+		jobs:            make(chan func()),
+		inFlight:        make(chan struct{}, maxInFlightBlocks),
+	}
+	for i := 0; i < parallelism; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// close stops the workers once the submitted transfers are done
+func (p *blockTransferPool) close() {
+	close(p.jobs)
+	p.workers.Wait()
+}
+
+func (p *blockTransferPool) acquire() {
+	p.inFlight <- struct{}{}
+}
+
+func (p *blockTransferPool) release() {
+	<-p.inFlight
+}
+
+// putBlock stores a block through the first reachable BlockStore in the
+// block's ranking, which copies it to the block's other owners
+func (p *blockTransferPool) putBlock(block *Block) error {
+	var err error
+	for _, addr := range BlockOwners(GetBlockHashString(block.GetBlockData()), p.blockStoreAddrs) {
+		var succ bool
+		if err = p.client.PutBlock(block, addr, &succ); err == nil {
+			return nil
+		}
+		log.Printf("PutBlock on %v failed: %v\n", addr, err)
+	}
+	return err
+}
+
+// getBlock fetches a block from its owners in ranking order, falling back to
+// the other BlockStores when an owner fails or lacks the block. During a
+// rebalance the block's previous owners are tried after the current ones.
+func (p *blockTransferPool) getBlock(hash string, block *Block) error {
+	addrs := BlockOwners(hash, p.blockStoreAddrs)
+	tried := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		tried[addr] = true
+	}
+	for _, addr := range BlockOwners(hash, p.previousAddrs) {
+		if !tried[addr] {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	var err error
+	for _, addr := range addrs {
+		if err = p.client.GetBlock(hash, addr, block); err == nil {
+			return nil
+		}
+		log.Printf("GetBlock on %v failed: %v\n", addr, err)
+	}
+	return err
+}
+
+// indexLocalBlocks records where each block of the indexed files sits in the
+// base dir. The index may be stale, so blocks are checked against their hash
+// when they are read.
+func (p *blockTransferPool) indexLocalBlocks(fileMetas map[string]*FileMetaData) {
+	p.localBlocks = make(map[string]localBlock)
+	p.sourceNames = make(map[string]bool)
+	p.sources = make(map[string]*os.File)
+	for _, fmd := range fileMetas {
+		if isDeleted(fmd) || fmd.GetSymlinkTarget() != "" {
+			continue
+		}
+		for i, hash := range fmd.GetBlockHashList() {
+			if _, ok := p.localBlocks[hash]; ok {
+				continue
+			}
+			p.localBlocks[hash] = localBlock{
+				filename: fmd.GetFilename(),
+				offset:   int64(i) * int64(p.client.BlockSize),
+			}
+			p.sourceNames[fmd.GetFilename()] = true
+		}
+	}
+}
+
+// openSource returns the open local file blocks are copied from, or nil if
+// it can't be read. Files stay open until the downloads are done, so a file
+// that is replaced by a download can still be read.
+func (p *blockTransferPool) openSource(filename string) *os.File {
+	p.sourcesMu.Lock()
+	defer p.sourcesMu.Unlock()
+	if file, ok := p.sources[filename]; ok {
+		return file
+	}
+	file, err := os.Open(ConcatPath(p.client.BaseDir, filename))
+	if err != nil {
+		file = nil
+	}
+	p.sources[filename] = file
+	return file
+}
+
+// dropSource closes a local file and stops copying blocks from it
+func (p *blockTransferPool) dropSource(filename string) {
+	p.sourcesMu.Lock()
+	defer p.sourcesMu.Unlock()
+	if file := p.sources[filename]; file != nil {
+		file.Close()
+	}
+	p.sources[filename] = nil
+}
+
+func (p *blockTransferPool) closeSources() {
+	p.sourcesMu.Lock()
+	defer p.sourcesMu.Unlock()
+	for _, file := range p.sources {
+		if file != nil {
+			file.Close()
+		}
+	}
+	p.sources = make(map[string]*os.File)
+}
+
+// createDownloadFile creates a new temp file in the base dir that a download
+// is written to. Unlike os.CreateTemp it leaves the permissions to the umask,
+// as os.Create would.
+func createDownloadFile(baseDir string) (*os.File, error) {
+	for {
+		name := DEFAULT_DOWNLOAD_TEMP_PREFIX + strconv.FormatUint(uint64(rand.Uint32()), 10)
+		file, err := os.OpenFile(ConcatPath(baseDir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+}
+
+// replaceLocalFile renames a downloaded temp file over a local file, or
+// removes the local file if tempPath is empty. The old version is kept open
+// first so its blocks can still be copied.
+func (p *blockTransferPool) replaceLocalFile(filename string, tempPath string) error {
+	filePath := ConcatPath(p.client.BaseDir, filename)
+	replace := func() error {
+		if tempPath != "" {
+			return os.Rename(tempPath, filePath)
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if !p.sourceNames[filename] {
+		return replace()
+	}
+	p.openSource(filename)
+	err := replace()
+	if err != nil {
+		// some platforms can't replace open files
+		p.dropSource(filename)
+		err = replace()
+	}
+	return err
+}
+
+// readLocalBlock copies a block from a local file, or returns nil if no local
+// file holds the block
+func (p *blockTransferPool) readLocalBlock(hash string) *Block {
+	loc, ok := p.localBlocks[hash]
+	if !ok {
+		return nil
+	}
+	file := p.openSource(loc.filename)
+	if file == nil {
+		return nil
+	}
+	buf := make([]byte, p.client.BlockSize)
+	n, err := file.ReadAt(buf, loc.offset)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	if GetBlockHashString(buf[:n]) != hash {
+		return nil
+	}
+	atomic.AddInt64(&p.reusedBlocks, 1)
+	return &Block{BlockData: buf[:n], BlockSize: int32(n)}
+}
+
+// firstError keeps the first error reported by concurrent transfers
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *firstError) set(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *firstError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// putBlocks stores the blocks of all files in the BlockStore. Files are read
+// one at a time while the workers store blocks of several files at once.
+func (p *blockTransferPool) putBlocks(fmds []*FileMetaData) error {
+	var pending sync.WaitGroup
+	var errs firstError
+
+	for _, fmd := range fmds {
+		if isDeleted(fmd) {
+			continue
+		}
+		err := forEachFileBlock(p.client, fmd, func(block *Block) error {
+			if err := errs.get(); err != nil {
+				return err
+			}
+			p.acquire()
+			pending.Add(1)
+			p.jobs <- func() {
+				defer pending.Done()
+				defer p.release()
+				if err := p.putBlock(block); err != nil {
+					errs.set(err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			errs.set(err)
+			break
+		}
+	}
+
+	pending.Wait()
+	return errs.get()
+}
+
+// downloadFiles rebuilds the files described by the server's metadata in the
+// base dir and returns their new local metadata. Blocks of several files are
+// fetched at once, and each file has a writer that appends its blocks in hash
+// list order as they arrive.
+func (p *blockTransferPool) downloadFiles(serverMDs []*FileMetaData) ([]*FileMetaData, error) {
+	var writers sync.WaitGroup
+	var errs firstError
+	var blockCount int64
+	localMDs := make([]*FileMetaData, 0, len(serverMDs))
+	defer p.closeSources()
+
+	for _, serverMD := range serverMDs {
+		if errs.get() != nil {
+			break
+		}
+		log.Printf("Downloading %v...\n", serverMD.GetFilename())
+		// file is deleted in server
+		if isDeleted(serverMD) {
+			if err := p.replaceLocalFile(serverMD.GetFilename(), ""); err != nil {
+				errs.set(err)
+				break
+			}
+			localMDs = append(localMDs, serverMD)
+			continue
+		}
+
+		fmd := &FileMetaData{
+			Filename:      serverMD.GetFilename(),
+			Version:       serverMD.GetVersion(),
+			BlockHashList: serverMD.GetBlockHashList(),
+			Mode:          serverMD.GetMode(),
+			Mtime:         serverMD.GetMtime(),
+			SymlinkTarget: serverMD.GetSymlinkTarget(),
+			Size:          serverMD.GetSize(),
+		}
+		localMDs = append(localMDs, fmd)
+
+		file, err := createDownloadFile(p.client.BaseDir)
+		if err != nil {
+			errs.set(err)
+			break
+		}
+		tempPath := file.Name()
+
+		if serverMD.GetSymlinkTarget() != "" && p.client.PreserveMetadata {
+			// the link is made under the temp name and renamed over the file
+			file.Close()
+			err := os.Remove(tempPath)
+			if err == nil {
+				err = os.Symlink(serverMD.GetSymlinkTarget(), tempPath)
+			}
+			if err == nil {
+				err = p.replaceLocalFile(fmd.GetFilename(), tempPath)
+			}
+			if err != nil {
+				os.Remove(tempPath)
+				errs.set(err)
+			}
+			continue
+		}
+
+		// the queue holds one channel per block in hash list order, it never
+		// holds more blocks than there are in-flight tokens
+		queue := make(chan chan *Block, cap(p.inFlight))
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for blockCh := range queue {
+				block := <-blockCh
+				if block != nil && errs.get() == nil {
+					if _, err := file.Write(block.GetBlockData()); err != nil {
+						errs.set(err)
+					}
+				}
+				p.release()
+			}
+			err := errs.get()
+			if err == nil {
+				err = file.Sync()
+			}
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil && p.client.PreserveMetadata {
+				err = applyFileMetadata(tempPath, fmd)
+			}
+			if err == nil {
+				err = p.replaceLocalFile(fmd.GetFilename(), tempPath)
+			}
+			if err != nil {
+				// the local file is left as it was
+				os.Remove(tempPath)
+				errs.set(err)
+			}
+		}()
+
+		for _, hash := range serverMD.GetBlockHashList() {
+			if errs.get() != nil {
+				break
+			}
+			p.acquire()
+			blockCh := make(chan *Block, 1)
+			queue <- blockCh
+			blockCount++
+			hash := hash
+			p.jobs <- func() {
+				if block := p.readLocalBlock(hash); block != nil {
+					blockCh <- block
+					return
+				}
+				var block Block
+				if err := p.getBlock(hash, &block); err != nil {
+					errs.set(err)
+					blockCh <- nil
+					return
+				}
+				blockCh <- &block
+			}
+		}
+		close(queue)
+	}
+
+	writers.Wait()
+	if blockCount > 0 {
+		log.Printf("Copied %v of %v downloaded blocks from local files\n", atomic.LoadInt64(&p.reusedBlocks), blockCount)
+	}
+	return localMDs, errs.get()
+}
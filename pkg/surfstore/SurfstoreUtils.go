@@ -1,42 +1,69 @@
 package surfstore
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
-// Implement the logic for a client syncing with the server here.
-func ClientSync(client RPCClient) {
+// Implement the logic for a client syncing with the server here. A failed sync
+// returns its error without writing the index.
+func ClientSync(client RPCClient) error {
 	// check if base dir is valid
 	baseDir := client.BaseDir
 	// log.Printf("base dir: %v\n", baseDir)
 	localFiles, err := ioutil.ReadDir(baseDir)
 	if err != nil {
-		fmt.Errorf("Error when trying to read client base directory: %v\n", err)
+		return fmt.Errorf("read client base directory: %w", err)
 	}
 
-	// check index.txt file
+	// check index.txt file, a dry run leaves the base dir untouched
 	indexPath := client.BaseDir + "/index.txt"
-	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
+	if _, err := os.Stat(indexPath); os.IsNotExist(err) && !client.DryRun {
 		// log.Print("Index file not exist\n")
 		file, err := os.Create(indexPath)
 		if err != nil {
-			log.Fatalf("Fail to create index file: %v\n", err)
+			return fmt.Errorf("create index file: %w", err)
 		}
 		defer file.Close()
 	}
 
 	// get file info map with local files
-	localFileInfoMap, err := LoadMetaFromMetaFile(client.BaseDir)
+	localFileInfoMap, localFileStatMap, err := LoadLocalIndex(client.BaseDir)
 	if err != nil {
-		log.Fatalf("Error when trying to load local file info map: %v\n", err)
+		return fmt.Errorf("load local file info map: %w", err)
 	}
 	// fmt.Println("local file info map: ")
 	// PrintMetaMap(localFileInfoMap)
 
+	// ignored files are left out of the sync, their index entries are kept as they are
+	ignore, err := LoadIgnoreFile(client.BaseDir, client.IgnorePatterns)
+	if err != nil {
+		return fmt.Errorf("load ignore patterns: %w", err)
+	}
+	ignoredFileInfoMap := make(map[string]*FileMetaData)
+	for filename, fmd := range localFileInfoMap {
+		if ignore.Match(filename, false) {
+			ignoredFileInfoMap[filename] = fmd
+			delete(localFileInfoMap, filename)
+		}
+	}
+	// the server's entries as of the last sync, before the scan changes them
+	syncedFileInfoMap := make(map[string]*FileMetaData, len(localFileInfoMap))
+	for filename, fmd := range localFileInfoMap {
+		syncedFileInfoMap[filename] = proto.Clone(fmd).(*FileMetaData)
+	}
+
 	fileDelete := make(map[string]bool)
 	for filename, _ := range localFileInfoMap {
 		fileDelete[filename] = false
@@ -48,91 +75,69 @@ func ClientSync(client RPCClient) {
 	// fileModified := make(map[string]string)
 	fileModified := make(map[string]bool)
 	fileNew := make(map[string]bool)
+	// deleted files that are back in the base dir
+	fileRevived := make(map[string]bool)
+	// hash lists the recorded stat data belongs to
+	scannedHashes := make(map[string]string)
 	for _, f := range localFiles {
 		log.Printf("file name: %v\n", f.Name())
-		if f.Name() == "index.txt" {
+		if isMetaFile(f.Name()) || ignore.Match(f.Name(), f.IsDir()) {
+			continue
+		}
+		currMD, currStat, err := scanLocalFile(client, f.Name(), localFileInfoMap[f.Name()], localFileStatMap[f.Name()])
+		if err == errIsDir {
+			// the base dir is synced flat, subdirectories such as .git are left alone
+			log.Printf("skipping directory %v\n", f.Name())
 			continue
 		}
-		file, err := os.Open(client.BaseDir + "/" + f.Name())
 		if err != nil {
-			log.Fatalf("Fail to open file %v: %v\n", f.Name(), err)
+			return fmt.Errorf("scan file %v: %w", f.Name(), err)
 		}
-		fileSize := f.Size()
-		blockNeeded := int(float64(fileSize)/float64(client.BlockSize)) + 1
-		log.Printf("Block needed: %v\n", blockNeeded)
+		localFileStatMap[f.Name()] = currStat
+		scannedHashes[f.Name()] = GetHashString(currMD.GetBlockHashList())
+		log.Printf("Block count: %v\n", len(currMD.GetBlockHashList()))
 
 		// file in index.txt, check if hash list is different
 		if fmd, ok := localFileInfoMap[f.Name()]; ok {
 			log.Printf("fmd hash list size: %v", len(fmd.GetBlockHashList()))
 			delete(fileDelete, f.Name())
-			thisHashList := make([]string, blockNeeded)
-			changed := false
-			for i := 0; i < blockNeeded; i++ {
-				buf := make([]byte, client.BlockSize)
-				size, err := file.Read(buf)
-				if err != nil {
-					// log.Printf("error when trying to get hash list: %v\n", err)
-					log.Fatalf("error when trying to get hash list: %v\n", err)
-				}
-				buf = buf[:size]
-
-				hashString := GetBlockHashString(buf)
-				thisHashList[i] = hashString
-				log.Printf("hash string: %v", hashString)
-				// log.Printf("fmd hash list: %v", fmd.GetBlockHashList()[i])
-				if i >= len(fmd.GetBlockHashList()) || hashString != fmd.GetBlockHashList()[i] {
-					changed = true
-				}
-			}
-			if blockNeeded != len(fmd.GetBlockHashList()) {
-				changed = true
+			if isDeleted(fmd) {
+				fileRevived[f.Name()] = true
 			}
-			// hashStr := GetHashString(thisHashList)
-			if changed {
-				localFileInfoMap[f.Name()].BlockHashList = thisHashList
-				//fileModified[f.Name()] = f.Name() + "," + strconv.Itoa(fmd.GetVersion()) + "," + hashStr
+			if localFileChanged(fmd, currMD, client.PreserveMetadata) {
+				fmd.BlockHashList = currMD.GetBlockHashList()
+				fmd.Mode = currMD.GetMode()
+				fmd.Mtime = currMD.GetMtime()
+				fmd.SymlinkTarget = currMD.GetSymlinkTarget()
+				fmd.Size = currMD.GetSize()
+				fmd.Deleted = false
+				fmd.DeletedAt = 0
 				fileModified[f.Name()] = true
 				log.Printf("%v changed", f.Name())
 			}
 		} else {
 			// new file
 			// file in dir not in index.txt
-			thisHashList := make([]string, blockNeeded)
-			for i := 0; i < blockNeeded; i++ {
-				buf := make([]byte, client.BlockSize)
-				size, err := file.Read(buf)
-				if err != nil {
-					// log.Printf("error when trying to get hash list: %v\n", err)
-					log.Fatalf("error when trying to get hash list: %v\n", err)
-				}
-				buf = buf[:size]
-
-				hashString := GetBlockHashString(buf)
-				thisHashList[i] = hashString
-			}
-			// hashStr := GetHashString(thisHashList)
-			// fileNew[f.Name()] = f.Name() + "," + strconv.Itoa(1) + "," + hashStr
-			fmd := &FileMetaData{
-				Filename:      f.Name(),
-				Version:       1,
-				BlockHashList: thisHashList,
-			}
-			localFileInfoMap[f.Name()] = fmd
+			currMD.Version = 1
+			localFileInfoMap[f.Name()] = currMD
 			fileNew[f.Name()] = true
 		}
 	}
 	log.Printf("size of local file info map: %v\n", len(localFileInfoMap))
 	// remaining key in fileDelete is the file that is deleted by client
+	vanished := make(map[string]*FileMetaData)
 	for filename, _ := range fileDelete {
-		if localFileInfoMap[filename].BlockHashList[0] == "0" {
+		if isDeleted(localFileInfoMap[filename]) {
 			// log.Println("File already delete")
-			break
+			continue
 		}
+		vanished[filename] = localFileInfoMap[filename]
 		// deleted file
 		fmd := &FileMetaData{
-			Filename:      filename,
-			Version:       localFileInfoMap[filename].GetVersion(),
-			BlockHashList: []string{"0"},
+			Filename:  filename,
+			Version:   localFileInfoMap[filename].GetVersion(),
+			Deleted:   true,
+			DeletedAt: time.Now().UnixNano(),
 		}
 		localFileInfoMap[filename] = fmd
 		fileModified[filename] = true
@@ -140,16 +145,28 @@ func ClientSync(client RPCClient) {
 	}
 
 	// connect to server
-	// download updated FileInfoMap
-	serverFileInfoMap := make(map[string]*FileMetaData)
-	err = client.GetFileInfoMap(&serverFileInfoMap)
+	// download the entries changed since the last sync
+	serverFileInfoMap, cursor, err := fetchServerFileInfoMap(client, syncedFileInfoMap, ignore.Fingerprint())
 	if err != nil {
-		// fmt.Errorf("Error when trying to get file info from server: %v\n", err)
-		log.Fatalf("Error when trying to get file info from server: %v\n", err)
+		return fmt.Errorf("get file info from server: %w", err)
 	}
 	log.Printf("size of server file info map: %v\n", len(serverFileInfoMap))
-	fmt.Println("server file info map")
-	PrintMetaMap(serverFileInfoMap)
+	for filename := range serverFileInfoMap {
+		if ignore.Match(filename, false) {
+			delete(serverFileInfoMap, filename)
+		}
+	}
+
+	// a vanished file and a new file with the same contents are a rename
+	renames := detectRenames(vanished, localFileInfoMap, fileNew, fileRevived)
+
+	// a dry run stops here and only reports what a sync would do
+	if client.DryRun {
+		renames = planRenames(renames, vanished, serverFileInfoMap)
+		PrintSyncPlan(planSync(localFileInfoMap, serverFileInfoMap, fileModified, fileNew, renames), renames)
+		return nil
+	}
+	commitRenames(client, renames, vanished, localFileInfoMap, serverFileInfoMap, fileModified, fileNew)
 
 	/* compare local index to remote index
 	1. remote index refers to a file not present in local index or base dir
@@ -163,246 +180,606 @@ func ClientSync(client RPCClient) {
 	2.3 update local index if success
 	*** might need to handle version conflict ***
 	*/
+	uploads := make([]*FileMetaData, 0)
+	downloads := make([]*FileMetaData, 0)
 	for fileName, fmd := range localFileInfoMap {
 		if serverMD, ok := serverFileInfoMap[fileName]; ok {
 			log.Printf("local version: %v", fmd.GetVersion())
 			log.Printf("server version: %v", serverMD.GetVersion())
 			modified := fileModified[fileName]
 			log.Printf("Modified? %v", modified)
-			// if dataA and dataB both have one file with different content, they have the same version, but the modified is false
-			// what to do to pass this test case? update sesrver
-			// check if local file hash list is different than server file
 			new := fileNew[fileName]
 			log.Printf("New file? %v", new)
 
-			if fmd.GetVersion() == serverMD.GetVersion() && !modified && !new {
+			switch getSyncAction(fmd, serverMD, modified, new) {
+			case SYNC_NONE:
 				continue
-			} else if fmd.GetVersion() == serverMD.GetVersion() && new {
-				cleintSideUpdate(client, serverMD, &localFileInfoMap)
-			} else if (fmd.GetVersion() > serverMD.GetVersion()) || (fmd.GetVersion() == serverMD.GetVersion() && modified) {
+			case SYNC_UPLOAD, SYNC_DELETE_REMOTE:
 				// server side file is old (or client side file is updated)
-				serverSideUpdate(client, fmd, modified, &localFileInfoMap)
-			} else {
-				// client side file is old
-				cleintSideUpdate(client, serverMD, &localFileInfoMap)
+				uploads = append(uploads, fmd)
+			default:
+				// client side file is old, or both sides changed and the server wins
+				downloads = append(downloads, serverMD)
 			}
 		} else {
-			uploadNew(client, fmd, &localFileInfoMap)
+			switch getMissingAction(fmd, fileModified[fileName], fileNew[fileName]) {
+			case SYNC_UPLOAD:
+				uploads = append(uploads, fmd)
+			case SYNC_DELETE_LOCAL:
+				// the file was deleted elsewhere and the tombstone expired before this sync
+				if err := os.Remove(ConcatPath(client.BaseDir, fileName)); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("remove %v: %w", fileName, err)
+				}
+				delete(localFileInfoMap, fileName)
+				delete(localFileStatMap, fileName)
+			default:
+				// the server no longer knows the deleted file, its tombstone has expired
+				delete(localFileInfoMap, fileName)
+			}
 		}
 	}
-	// server2 := make(map[string]*FileMetaData)
-	// err = client.GetFileInfoMap(&server2)
-	// log.Printf("size of server file info map: %v\n", len(server2))
-	// for fileName, fmd := range fileNew {
-	// 	if serverMD, ok := serverFileInfoMap[fileName]; ok {
-	// 		clientSideUpdate(client, fmd, false, )
-	// 	} else {
-	// 		uploadNew(client, fmd)
-	// 	}
-	// }
 
 	// download new files from server
 	for filename, serverMD := range serverFileInfoMap {
 		if _, exist := localFileInfoMap[filename]; !exist {
-			localMD, err := download(client, filename, serverMD)
-			if err != nil {
-				// log.Printf("Failed to download file from server: %v\n", err)
-				log.Fatalf("Failed to download file from server: %v\n", err)
+			downloads = append(downloads, serverMD)
+		}
+	}
+
+	// files renamed by other clients are renamed locally instead of downloaded
+	downloads, err = applyRenames(client, downloads, localFileInfoMap)
+	if err != nil {
+		return fmt.Errorf("rename files: %w", err)
+	}
+
+	if len(uploads) > 0 || len(downloads) > 0 {
+		var blockStoreAddrs BlockStoreAddrs
+		err = client.GetBlockStoreAddrs(&blockStoreAddrs)
+		if err != nil {
+			return fmt.Errorf("get block store address: %w", err)
+		}
+		pool := newBlockTransferPool(client, &blockStoreAddrs)
+		defer pool.close()
+
+		// files the server rejected because of a version mismatch are downloaded instead
+		rejected, err := uploadFiles(client, pool, uploads, serverFileInfoMap, &localFileInfoMap)
+		if err != nil {
+			return fmt.Errorf("upload files: %w", err)
+		}
+		downloads = append(downloads, rejected...)
+
+		// blocks already in local files are copied instead of fetched
+		pool.indexLocalBlocks(localFileInfoMap)
+		downloaded, err := pool.downloadFiles(downloads)
+		if err != nil {
+			return fmt.Errorf("download files from server: %w", err)
+		}
+		for _, fmd := range downloaded {
+			localFileInfoMap[fmd.GetFilename()] = fmd
+		}
+	}
+
+	// files written by this sync need fresh stat data
+	for filename, fmd := range localFileInfoMap {
+		if isDeleted(fmd) {
+			delete(localFileStatMap, filename)
+		} else if GetHashString(fmd.GetBlockHashList()) != scannedHashes[filename] {
+			delete(localFileStatMap, filename)
+			if info, _, err := statLocalFile(client, filename, fmd); err == nil {
+				localFileStatMap[filename] = newLocalFileStat(info, client.BlockSize)
 			}
-			localFileInfoMap[filename] = localMD
 		}
 	}
-	fmt.Println("local file info map: ")
-	PrintMetaMap(localFileInfoMap)
 
-	err = WriteMetaFile(localFileInfoMap, client.BaseDir)
-	// if err != nil {
-	// 	log.Fatal("Fail to update index.txt: %v\n", err)
-	// }
+	for filename, fmd := range ignoredFileInfoMap {
+		localFileInfoMap[filename] = fmd
+	}
+	if err := WriteLocalIndex(localFileInfoMap, localFileStatMap, client.BaseDir); err != nil {
+		return fmt.Errorf("update index.txt: %w", err)
+	}
+	if cursor != nil {
+		if cursor.Index, err = localIndexHash(client.BaseDir); err == nil {
+			err = WriteSyncCursor(cursor, client.BaseDir)
+		}
+		if err != nil {
+			return fmt.Errorf("update %v: %w", DEFAULT_CURSOR_FILENAME, err)
+		}
+	}
 
 	// handle conflict
+	return nil
 }
 
-func GetHashString(hashList []string) string {
-	hashStr := ""
-	for i, hash := range hashList {
-		hashStr += hash
-		if i != (len(hashList) - 1) {
-			hashStr += " "
+// fetchServerFileInfoMap returns the server's file map and the cursor to
+// record once the sync is done. Only the entries committed since the cursor of
+// the last sync are fetched, the others are the entries of the last sync's
+// index. The whole namespace is listed page by page if the index or the ignore
+// rules changed since, because the index then no longer tells what the server
+// holds, or if the changes do not fit in one message. Servers without a change
+// feed are asked for the full map, in which case the cursor is nil.
+func fetchServerFileInfoMap(client RPCClient, syncedFileInfoMap map[string]*FileMetaData, ignoreFingerprint string) (map[string]*FileMetaData, *SyncCursor, error) {
+	stored, err := LoadSyncCursor(client.BaseDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexHash, err := localIndexHash(client.BaseDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	since := stored.Cursor
+	if stored.Index != indexHash || stored.Ignore != ignoreFingerprint {
+		since = ""
+	}
+
+	if since != "" {
+		var changes Changes
+		err = client.GetChangesSince(since, &changes)
+		if err == nil {
+			log.Printf("changes since %q: %v, full: %v\n", since, len(changes.GetFileInfoMap()), changes.GetFull())
+			serverFileInfoMap := make(map[string]*FileMetaData)
+			if !changes.GetFull() {
+				for filename, fmd := range syncedFileInfoMap {
+					serverFileInfoMap[filename] = fmd
+				}
+			}
+			for filename, fmd := range changes.GetFileInfoMap() {
+				serverFileInfoMap[filename] = fmd
+			}
+			return serverFileInfoMap, &SyncCursor{Cursor: changes.GetCursor(), Ignore: ignoreFingerprint}, nil
+		}
+		if code := status.Code(err); code != codes.ResourceExhausted && code != codes.Unimplemented {
+			return nil, nil, err
 		}
 	}
-	return hashStr
-}
 
-func serverSideUpdate(client RPCClient, clientMD *FileMetaData, modified bool, localFileInfoMap *map[string]*FileMetaData) {
-	log.Printf("Update server...")
-	// if client file has been updated, version needs to be udpated
-	if modified {
-		clientMD.Version += 1
-		(*localFileInfoMap)[clientMD.GetFilename()] = clientMD
+	serverFileInfoMap := make(map[string]*FileMetaData)
+	cursor, err := WalkFiles(client, "", true, func(fmd *FileMetaData) error {
+		serverFileInfoMap[fmd.GetFilename()] = fmd
+		return nil
+	})
+	if status.Code(err) == codes.Unimplemented {
+		err = client.GetFileInfoMap(&serverFileInfoMap)
+		return serverFileInfoMap, nil, err
+	} else if err != nil {
+		return nil, nil, err
 	}
-	err := uploadNew(client, clientMD, localFileInfoMap)
-	if err != nil {
-		// log.Printf("Fail to upload file: %v\n", err)
-		log.Fatalf("Fail to upload file: %v\n", err)
+	log.Printf("listed %v files\n", len(serverFileInfoMap))
+	return serverFileInfoMap, &SyncCursor{Cursor: cursor, Ignore: ignoreFingerprint}, nil
+}
+
+// WalkFiles lists the server's files whose names start with a prefix in name
+// order, one ListFiles page at a time, and calls visit for each. Tombstones are
+// included if includeDeleted is set. It returns the change cursor of the first
+// page, from which GetChangesSince returns every change the walk may have missed.
+func WalkFiles(client RPCClient, prefix string, includeDeleted bool, visit func(fmd *FileMetaData) error) (string, error) {
+	return walkFiles(client, &ListFilesRequest{Prefix: prefix, IncludeDeleted: includeDeleted}, visit)
+}
+
+// WalkSnapshotFiles lists the files of a snapshot in name order, one ListFiles
+// page at a time, and calls visit for each
+func WalkSnapshotFiles(client RPCClient, name string, visit func(fmd *FileMetaData) error) error {
+	_, err := walkFiles(client, &ListFilesRequest{Snapshot: name}, visit)
+	return err
+}
+
+func walkFiles(client RPCClient, request *ListFilesRequest, visit func(fmd *FileMetaData) error) (string, error) {
+	cursor := ""
+	for {
+		var fileList FileList
+		if err := client.ListFiles(request, &fileList); err != nil {
+			return "", err
+		}
+		if cursor == "" {
+			cursor = fileList.GetCursor()
+		}
+		for _, fmd := range fileList.GetFiles() {
+			if err := visit(fmd); err != nil {
+				return "", err
+			}
+		}
+		if fileList.GetNextPageToken() == "" {
+			return cursor, nil
+		}
+		request.PageToken = fileList.GetNextPageToken()
 	}
 }
 
-func cleintSideUpdate(client RPCClient, serverMD *FileMetaData, localFileInfoMap *map[string]*FileMetaData) {
-	log.Printf("Update client...")
-	downloadMD, err := download(client, serverMD.GetFilename(), serverMD)
+// PrintFile prints a file's version, size and name on one line
+func PrintFile(fmd *FileMetaData) {
+	fmt.Printf("%8v %12v %v\n", fmd.GetVersion(), fmd.GetSize(), fmd.GetFilename())
+}
 
+// CheckoutSnapshot writes the files of a snapshot into the client's base dir,
+// which is created if needed. Files of the base dir outside the snapshot are left
+// untouched and the local index is not written, so the base dir is an export
+// rather than a synced directory.
+func CheckoutSnapshot(client RPCClient, name string) error {
+	var serverMDs []*FileMetaData
+	err := WalkSnapshotFiles(client, name, func(fmd *FileMetaData) error {
+		if !isDeleted(fmd) {
+			serverMDs = append(serverMDs, fmd)
+		}
+		return nil
+	})
 	if err != nil {
-		// log.Printf("Fail to download file from server: %v\n", err)
-		log.Fatalf("Fail to download file from server: %v\n", err)
+		return err
 	}
-	(*localFileInfoMap)[serverMD.GetFilename()] = downloadMD
+	if err := os.MkdirAll(client.BaseDir, 0755); err != nil {
+		return err
+	}
+	if len(serverMDs) == 0 {
+		return nil
+	}
+
+	var blockStoreAddrs BlockStoreAddrs
+	if err := client.GetBlockStoreAddrs(&blockStoreAddrs); err != nil {
+		return err
+	}
+	pool := newBlockTransferPool(client, &blockStoreAddrs)
+	defer pool.close()
+	_, err = pool.downloadFiles(serverMDs)
+	return err
 }
 
-func uploadNew(client RPCClient, fmd *FileMetaData, localFileInfoMap *map[string]*FileMetaData) error {
-	log.Println("Start uploading...")
-	// log.Printf("File name: %v\n", fmd.GetFilename())
-	filePath := client.BaseDir + "/" + fmd.GetFilename()
-	// log.Printf("File path: %v\n", filePath)
-
-	if _, e := os.Stat(filePath); os.IsNotExist(e) {
-		var version int32
-		err := client.UpdateFile(fmd, &version)
-		fmt.Printf("Version: %v\n", version)
-		fmt.Printf("FMD version: %v\n", fmd.GetVersion())
-		if err != nil {
-			log.Printf("Failed to update file: %v\n", err)
-			// log.Fatalf("Failed to update file: %v\n", err)
+// PrintSnapshots prints the name, creation time and file count of each snapshot
+func PrintSnapshots(snapshots []*Snapshot) {
+	for _, snapshot := range snapshots {
+		createdAt := time.Unix(0, snapshot.GetCreatedAt()).Format(time.RFC3339)
+		fmt.Printf("%-24s %v %v files\n", snapshot.GetName(), createdAt, snapshot.GetFileCount())
+	}
+}
+
+// PrintUsage prints the server's usage against its quotas
+func PrintUsage(usage *Usage) {
+	printQuota := func(name string, used int64, quota int64) {
+		if quota <= 0 {
+			fmt.Printf("%-6s %v used, unlimited\n", name, used)
+			return
 		}
-		return err
+		remaining := quota - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		fmt.Printf("%-6s %v of %v used, %v remaining\n", name, used, quota, remaining)
 	}
+	printQuota("bytes", usage.GetBytes(), usage.GetQuotaBytes())
+	printQuota("files", usage.GetFiles(), usage.GetQuotaFiles())
+}
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		// log.Printf("Fail to open file: %v\n", err)
-		log.Fatalf("Fail to open file: %v\n", err)
+// SyncAction is the change a sync makes for a single file
+type SyncAction int
+
+const (
+	SYNC_NONE SyncAction = iota
+	SYNC_UPLOAD
+	SYNC_DOWNLOAD
+	SYNC_DELETE_LOCAL
+	SYNC_DELETE_REMOTE
+	SYNC_CONFLICT
+	SYNC_RENAME
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case SYNC_UPLOAD:
+		return "upload"
+	case SYNC_DOWNLOAD:
+		return "download"
+	case SYNC_DELETE_LOCAL:
+		return "delete locally"
+	case SYNC_DELETE_REMOTE:
+		return "delete remotely"
+	case SYNC_CONFLICT:
+		return "conflict"
+	case SYNC_RENAME:
+		return "rename"
+	default:
+		return "none"
 	}
-	defer file.Close()
+}
 
-	f, _ := os.Stat(filePath)
-	blockNeeded := int(float64(f.Size())/float64(client.BlockSize)) + 1
-	// fmt.Printf("block needed: %v\n", blockNeeded)
-	log.Printf("block needed: %v\n", blockNeeded)
+// isDeleted reports whether the metadata is a tombstone of a deleted file
+func isDeleted(fmd *FileMetaData) bool {
+	return fmd.GetDeleted()
+}
+
+// getSyncAction decides what to do with a file known to both the local index and the server.
+// When both sides changed the file the server wins, which is reported as a conflict, except
+// that a file changed or created locally wins over a deletion on the server, so its
+// contents are never lost.
+func getSyncAction(localMD *FileMetaData, serverMD *FileMetaData, modified bool, new bool) SyncAction {
+	localVersion := localMD.GetVersion()
+	serverVersion := serverMD.GetVersion()
 
-	for i := 0; i < blockNeeded; i++ {
-		var block Block
-		block.BlockData = make([]byte, client.BlockSize)
-		n, err := file.Read(block.BlockData)
-		if err != nil && err != io.EOF {
-			// log.Printf("Fail to read file: %v\n", err)
-			log.Fatalf("Fail to read file: %v\n", err)
+	if localVersion == serverVersion && !modified && !new {
+		return SYNC_NONE
+	}
+	if isDeleted(serverMD) && !isDeleted(localMD) && (modified || new) {
+		return SYNC_UPLOAD
+	}
+	if localVersion > serverVersion || (localVersion == serverVersion && modified && !new) {
+		if isDeleted(localMD) {
+			return SYNC_DELETE_REMOTE
 		}
-		block.BlockSize = int32(n)
-		block.BlockData = block.BlockData[:n]
+		return SYNC_UPLOAD
+	}
+	if (modified || new) && GetHashString(localMD.GetBlockHashList()) != GetHashString(serverMD.GetBlockHashList()) {
+		return SYNC_CONFLICT
+	}
+	if isDeleted(serverMD) {
+		return SYNC_DELETE_LOCAL
+	}
+	return SYNC_DOWNLOAD
+}
 
-		var blockStoreAddr string
-		err = client.GetBlockStoreAddr(&blockStoreAddr)
-		if err != nil {
-			// log.Printf("Fail to get block store address: %v\n", err)
-			log.Fatalf("Fail to get block store address: %v\n", err)
+// getMissingAction decides what to do with a file of the local index the server does
+// not know. Files created or changed locally are uploaded. An unchanged file the server
+// forgot was deleted by another client whose tombstone expired before this client
+// synced, so it is deleted locally; a local tombstone is simply forgotten.
+func getMissingAction(localMD *FileMetaData, modified bool, new bool) SyncAction {
+	if isDeleted(localMD) {
+		return SYNC_NONE
+	}
+	if modified || new {
+		return SYNC_UPLOAD
+	}
+	return SYNC_DELETE_LOCAL
+}
+
+// planSync computes the action of every file without touching the base dir or the server.
+// Renames the server would accept, by new name, replace the upload of the new name and
+// the deletion of the old one.
+func planSync(localFileInfoMap map[string]*FileMetaData, serverFileInfoMap map[string]*FileMetaData, fileModified map[string]bool, fileNew map[string]bool, renames map[string]string) map[string]SyncAction {
+	plan := make(map[string]SyncAction)
+	for filename, localMD := range localFileInfoMap {
+		if serverMD, ok := serverFileInfoMap[filename]; ok {
+			plan[filename] = getSyncAction(localMD, serverMD, fileModified[filename], fileNew[filename])
+		} else {
+			plan[filename] = getMissingAction(localMD, fileModified[filename], fileNew[filename])
 		}
-		// log.Printf("block store addr: %v\n", blockStoreAddr)
-		var succ bool
-		err = client.PutBlock(&block, blockStoreAddr, &succ)
-		// log.Printf("Put block success? %v\n", succ)
-		if err != nil {
-			// log.Printf("Fail to put block: %v\n", err)
-			log.Fatalf("Fail to put block: %v\n", err)
+	}
+	for filename, serverMD := range serverFileInfoMap {
+		if _, ok := localFileInfoMap[filename]; !ok && !isDeleted(serverMD) {
+			plan[filename] = SYNC_DOWNLOAD
+		}
+	}
+	for newName, oldName := range renames {
+		plan[newName] = SYNC_RENAME
+		delete(plan, oldName)
+	}
+	return plan
+}
+
+// PrintSyncPlan prints the planned action of every file that would change, sorted by
+// name. Renames are printed with the old name they move from.
+func PrintSyncPlan(plan map[string]SyncAction, renames map[string]string) {
+	filenames := make([]string, 0, len(plan))
+	for filename, action := range plan {
+		if action != SYNC_NONE {
+			filenames = append(filenames, filename)
 		}
+	}
+	sort.Strings(filenames)
 
+	if len(filenames) == 0 {
+		fmt.Println("Everything up to date")
+		return
 	}
+	for _, filename := range filenames {
+		if plan[filename] == SYNC_RENAME {
+			fmt.Printf("%-16s %v -> %v\n", plan[filename].String(), renames[filename], filename)
+			continue
+		}
+		fmt.Printf("%-16s %v\n", plan[filename].String(), filename)
+	}
+}
 
-	var version int32
-	err = client.UpdateFile(fmd, &version)
-	fmt.Printf("Version: %v\n", version)
-	fmt.Printf("FMD version: %v\n", fmd.GetVersion())
+// statLocalFile returns the stat data of a file in the base dir. Symlinks are treated
+// as links when the client preserves file metadata or the index already tracks them
+// as links, otherwise they are read as the files they point to.
+func statLocalFile(client RPCClient, filename string, indexMD *FileMetaData) (info os.FileInfo, isLink bool, err error) {
+	filePath := ConcatPath(client.BaseDir, filename)
+	if info, err = os.Lstat(filePath); err != nil {
+		return nil, false, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 && (client.PreserveMetadata || indexMD.GetSymlinkTarget() != "") {
+		return info, true, nil
+	}
+	if info, err = os.Stat(filePath); err != nil {
+		return nil, false, err
+	}
+	return info, false, nil
+}
 
+func newLocalFileStat(info os.FileInfo, blockSize int) *LocalFileStat {
+	return &LocalFileStat{
+		Size:      info.Size(),
+		Mtime:     info.ModTime().UnixNano(),
+		Inode:     getInode(info),
+		BlockSize: blockSize,
+	}
+}
+
+// errIsDir is returned when scanning a directory, or a symlink read as the
+// directory it points to
+var errIsDir = errors.New("is a directory")
+
+// scanLocalFile builds the metadata of a file in the base dir without a version.
+// The file is only hashed when its stat data differs from the cached stat data,
+// the block size changed since it was hashed, or the client forces a full rehash.
+func scanLocalFile(client RPCClient, filename string, indexMD *FileMetaData, cachedStat *LocalFileStat) (*FileMetaData, *LocalFileStat, error) {
+	info, isLink, err := statLocalFile(client, filename, indexMD)
 	if err != nil {
-		log.Printf("Failed to update file: %v\n", err)
-		return err
+		return nil, nil, err
 	}
-	if version == -1 {
-		// version mismatch
-		log.Println("Version mismatch")
-		// log.Fatalf("Failed to update file: %v\n", err)
-		// download newest files from server
-		serverFileInfoMap := make(map[string]*FileMetaData)
-		err = client.GetFileInfoMap(&serverFileInfoMap)
-		if err != nil {
-			// log.Printf("Fail to get file info: %v\n", err)
-			log.Fatalf("Fail to get file info: %v\n", err)
+	if info.IsDir() {
+		return nil, nil, errIsDir
+	}
+
+	currMD := &FileMetaData{
+		Filename: filename,
+		Mode:     uint32(info.Mode().Perm()),
+		Mtime:    info.ModTime().UnixNano(),
+	}
+	if isLink {
+		// the content of a symlink is its target
+		if currMD.SymlinkTarget, err = os.Readlink(ConcatPath(client.BaseDir, filename)); err != nil {
+			return nil, nil, err
 		}
-		cleintSideUpdate(client, serverFileInfoMap[fmd.GetFilename()], localFileInfoMap)
 	}
-	log.Println("Finish uploading...")
-	return err
+
+	currStat := newLocalFileStat(info, client.BlockSize)
+	if indexMD != nil && !isDeleted(indexMD) && cachedStat != nil && *cachedStat == *currStat && !client.Rehash {
+		currMD.BlockHashList = indexMD.GetBlockHashList()
+		currMD.Size = info.Size()
+		if isLink {
+			currMD.Size = int64(len(currMD.GetSymlinkTarget()))
+		}
+		return currMD, currStat, nil
+	}
+
+	// the size is the sum of the block sizes
+	err = forEachFileBlock(client, currMD, func(block *Block) error {
+		currMD.BlockHashList = append(currMD.BlockHashList, GetBlockHashString(block.GetBlockData()))
+		currMD.Size += int64(len(block.GetBlockData()))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return currMD, currStat, nil
 }
 
-func download(client RPCClient, filename string, serverMD *FileMetaData) (*FileMetaData, error) {
-	log.Println("Start downloading...")
-	filePath := client.BaseDir + "/" + filename
+// localFileChanged compares the indexed metadata of a file with its current state.
+// Mode and symlink changes only count when the client preserves file metadata.
+func localFileChanged(indexMD *FileMetaData, currMD *FileMetaData, preserveMetadata bool) bool {
+	if GetHashString(indexMD.GetBlockHashList()) != GetHashString(currMD.GetBlockHashList()) {
+		return true
+	}
+	if preserveMetadata {
+		return indexMD.GetMode() != currMD.GetMode() || indexMD.GetSymlinkTarget() != currMD.GetSymlinkTarget()
+	}
+	return false
+}
 
-	var file *os.File
-	var err error
-	if _, e := os.Stat(filePath); os.IsNotExist(e) {
-		file, err = os.Create(filePath)
-		if err != nil {
-			log.Fatalf("Fail to create file: %v\n", err)
-		}
-	} else {
-		err = os.Remove(filePath)
-		if err != nil {
-			log.Fatalf("Fail to delete file: %v\n", err)
+// applyFileMetadata sets the mode and mtime recorded in the metadata on a downloaded file
+func applyFileMetadata(filePath string, fmd *FileMetaData) error {
+	if fmd.GetMode() != 0 {
+		if err := os.Chmod(filePath, os.FileMode(fmd.GetMode())); err != nil {
+			return err
 		}
-		file, err = os.Create(filePath)
-		if err != nil {
-			log.Fatalf("Fail to create file: %v\n", err)
+	}
+	if fmd.GetMtime() != 0 {
+		mtime := time.Unix(0, fmd.GetMtime())
+		if err := os.Chtimes(filePath, mtime, mtime); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// file is deleted in server
-	if len(serverMD.GetBlockHashList()) == 1 && serverMD.GetBlockHashList()[0] == "0" {
-		err := os.Remove(filePath)
-		if err != nil {
-			log.Printf("Fail to delete file: %v\n", err)
-			// log.Fatalf("Fail to delete file: %v\n", err)
+func GetHashString(hashList []string) string {
+	hashStr := ""
+	for i, hash := range hashList {
+		hashStr += hash
+		if i != (len(hashList) - 1) {
+			hashStr += " "
 		}
-		return serverMD, err
 	}
+	return hashStr
+}
 
-	var blockStoreAddr string
-	err = client.GetBlockStoreAddr(&blockStoreAddr)
-	if err != nil {
-		// log.Printf("Fail to get block store address: %v\n", err)
-		log.Fatalf("Fail to get block store address: %v\n", err)
+// uploadFiles stores the blocks of the files and then commits their metadata on the
+// server in one transaction. Files that conflict with the server are left out and the
+// rest is committed again; the server's metadata of the conflicting files is returned
+// so they can be downloaded.
+func uploadFiles(client RPCClient, pool *blockTransferPool, fmds []*FileMetaData, serverFileInfoMap map[string]*FileMetaData, localFileInfoMap *map[string]*FileMetaData) ([]*FileMetaData, error) {
+	log.Println("Start uploading...")
+	if err := pool.putBlocks(fmds); err != nil {
+		return nil, err
 	}
 
-	for i, hash := range serverMD.GetBlockHashList() {
-		// fmt.Printf("hash list %v\n", i)
-		log.Printf("hash list %v\n", i)
-		var block Block
-		err := client.GetBlock(hash, blockStoreAddr, &block)
-		log.Printf("Block size: %v\n", block.GetBlockSize())
-		if err != nil {
-			// log.Printf("Fail to get block: %v\n", err)
-			log.Fatalf("Fail to get block: %v\n", err)
+	pending := make(map[string]*FileUpdate)
+	for _, fmd := range fmds {
+		expected := serverFileInfoMap[fmd.GetFilename()].GetVersion()
+		// the version only moves forward from what the server holds
+		fmd.Version = expected + 1
+		pending[fmd.GetFilename()] = &FileUpdate{FileMetaData: fmd, ExpectedVersion: expected}
+	}
+
+	serverMDs := make([]*FileMetaData, 0)
+	for len(pending) > 0 {
+		fileUpdates := make([]*FileUpdate, 0, len(pending))
+		for _, update := range pending {
+			fileUpdates = append(fileUpdates, update)
+		}
+
+		var conflicts []*FileConflict
+		if err := client.UpdateFiles(fileUpdates, &conflicts); err != nil {
+			return nil, err
+		}
+		if len(conflicts) == 0 {
+			break
+		}
+
+		for _, conflict := range conflicts {
+			log.Printf("Version mismatch: %v\n", conflict.GetFilename())
+			update := pending[conflict.GetFilename()]
+			if current := conflict.GetCurrent(); current.GetDeleted() && !isDeleted(update.GetFileMetaData()) {
+				// the file was deleted meanwhile, the local contents win over the deletion
+				update.ExpectedVersion = current.GetVersion()
+				update.FileMetaData.Version = current.GetVersion() + 1
+			} else if conflict.GetCurrent() != nil {
+				// the server wins, download its version
+				serverMDs = append(serverMDs, conflict.GetCurrent())
+				delete(pending, conflict.GetFilename())
+			} else if isDeleted(update.GetFileMetaData()) {
+				// the server no longer knows the deleted file
+				delete(*localFileInfoMap, conflict.GetFilename())
+				delete(pending, conflict.GetFilename())
+			} else {
+				// the server no longer knows the file, upload it as a new one
+				update.ExpectedVersion = 0
+				update.FileMetaData.Version = 1
+			}
 		}
+	}
+	log.Println("Finish uploading...")
+	return serverMDs, nil
+}
 
-		_, err = file.Write(block.BlockData)
+// forEachFileBlock reads a local file block by block in order, using the client's block size.
+// The content of a symlink preserved as a link is its target.
+func forEachFileBlock(client RPCClient, fmd *FileMetaData, fn func(block *Block) error) error {
+	var reader io.Reader
+	if fmd.GetSymlinkTarget() != "" {
+		reader = strings.NewReader(fmd.GetSymlinkTarget())
+	} else {
+		file, err := os.Open(ConcatPath(client.BaseDir, fmd.GetFilename()))
 		if err != nil {
-			log.Fatalf("Fail to write block data: %v\n", err)
+			return err
 		}
+		defer file.Close()
+		reader = file
 	}
-	fmd := &FileMetaData{
-		Filename:      serverMD.GetFilename(),
-		Version:       serverMD.GetVersion(),
-		BlockHashList: serverMD.GetBlockHashList(),
+
+	count := 0
+	for {
+		data := make([]byte, client.BlockSize)
+		n, err := io.ReadFull(reader, data)
+		// an empty file is a single empty block
+		if err == io.EOF && count > 0 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if err = fn(&Block{BlockData: data[:n], BlockSize: int32(n)}); err != nil {
+			return err
+		}
+		count++
+		if n < client.BlockSize {
+			break
+		}
 	}
-	log.Println("Finish downloading...")
-	return fmd, err
+	return nil
 }
@@ -0,0 +1,337 @@
+// Package surfstoretest runs a MetaStore and a BlockStore inside the test
+// process and syncs clients against them, so sync behavior can be tested
+// without starting servers or opening ports.
+package surfstoretest
+
+import (
+	context "context"
+	"cse224/proj4/pkg/surfstore"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Addresses the in-process servers are dialed at
+const METASTORE_ADDR string = "metastore"
+const BLOCKSTORE_ADDR string = "blockstore"
+
+// BUFCONN_SIZE is the buffer of each in-memory connection
+const BUFCONN_SIZE int = 1024 * 1024
+
+// DEFAULT_BLOCK_SIZE is small so short test files span several blocks
+const DEFAULT_BLOCK_SIZE int = 16
+
+// Cluster is a MetaStore and a BlockStore served over in-memory bufconn
+// listeners. The servers are stopped when the test finishes.
+type Cluster struct {
+	MetaStore  *surfstore.MetaStore
+	BlockStore *surfstore.BlockStore
+
+	t testing.TB
+	// mu guards the servers and listeners, which BlockStores are stopped and
+	// served again while others dial them, and the call counts
+	mu        sync.Mutex
+	servers   map[string]*grpc.Server
+	listeners map[string]*bufconn.Listener
+	calls     map[string]int
+}
+
+func NewCluster(t testing.TB) *Cluster {
+	t.Helper()
+	c := &Cluster{
+		MetaStore:  surfstore.NewMetaStore(BLOCKSTORE_ADDR),
+		BlockStore: surfstore.NewBlockStore(),
+		t:          t,
+		servers:    make(map[string]*grpc.Server),
+		listeners:  make(map[string]*bufconn.Listener),
+		calls:      make(map[string]int),
+	}
+	c.MetaStore.DialOptions = c.DialOptions()
+	c.serve(METASTORE_ADDR, func(s *grpc.Server) {
+		surfstore.RegisterMetaStoreServer(s, c.MetaStore)
+	})
+	c.serve(BLOCKSTORE_ADDR, func(s *grpc.Server) {
+		surfstore.RegisterBlockStoreServer(s, c.BlockStore)
+	})
+	return c
+}
+
+// AddBlockStore serves another BlockStore at an address. The MetaStore only
+// hands it out to clients once it is added to the MetaStore's BlockStoreAddrs.
+func (c *Cluster) AddBlockStore(addr string) *surfstore.BlockStore {
+	blockStore := surfstore.NewBlockStore()
+	c.ServeBlockStore(addr, blockStore)
+	return blockStore
+}
+
+// ServeBlockStore serves a BlockStore at an address, for example a new one
+// with the Storage of a stopped BlockStore to restart it
+func (c *Cluster) ServeBlockStore(addr string, blockStore *surfstore.BlockStore) {
+	c.serve(addr, func(s *grpc.Server) {
+		surfstore.RegisterBlockStoreServer(s, blockStore)
+	})
+}
+
+// StopBlockStore stops the server at an address. Dialing the address fails
+// until a BlockStore is served there again.
+func (c *Cluster) StopBlockStore(addr string) {
+	c.mu.Lock()
+	s := c.servers[addr]
+	delete(c.servers, addr)
+	delete(c.listeners, addr)
+	c.mu.Unlock()
+	if s != nil {
+		s.Stop()
+	}
+}
+
+// DialOptions reach the cluster's servers from servers of the cluster
+func (c *Cluster) DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{grpc.WithContextDialer(c.dial)}
+}
+
+func (c *Cluster) serve(addr string, register func(s *grpc.Server)) {
+	listener := bufconn.Listen(BUFCONN_SIZE)
+	s := grpc.NewServer(grpc.UnaryInterceptor(c.countCall))
+	register(s)
+	c.mu.Lock()
+	c.servers[addr] = s
+	c.listeners[addr] = listener
+	c.mu.Unlock()
+	go s.Serve(listener)
+	c.t.Cleanup(s.Stop)
+}
+
+// countCall counts the calls of each method before handling them
+func (c *Cluster) countCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	c.mu.Lock()
+	c.calls[path.Base(info.FullMethod)]++
+	c.mu.Unlock()
+	return handler(ctx, req)
+}
+
+// Calls returns how often the cluster's servers were called with a method,
+// such as GetBlock, since the cluster started
+func (c *Cluster) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[method]
+}
+
+// dial connects to the in-process server listening at an address
+func (c *Cluster) dial(ctx context.Context, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	listener, ok := c.listeners[addr]
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no server at %v", addr)
+	}
+	return listener.DialContext(ctx)
+}
+
+// Client is a sync client with its own base dir in a temporary directory.
+// Its RPCClient fields can be changed before syncing, e.g. IgnorePatterns.
+type Client struct {
+	surfstore.RPCClient
+
+	t testing.TB
+}
+
+// NewClient returns a client of the cluster with an empty base dir
+func (c *Cluster) NewClient() *Client {
+	c.t.Helper()
+	rpcClient := surfstore.NewSurfstoreRPCClient(METASTORE_ADDR, c.t.TempDir(), DEFAULT_BLOCK_SIZE)
+	rpcClient.DialOptions = c.DialOptions()
+	return &Client{RPCClient: rpcClient, t: c.t}
+}
+
+// NewClients returns n clients of the cluster
+func (c *Cluster) NewClients(n int) []*Client {
+	c.t.Helper()
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = c.NewClient()
+	}
+	return clients
+}
+
+// Sync runs ClientSync on the client's base dir and fails the test if the
+// sync fails
+func (c *Client) Sync() {
+	c.t.Helper()
+	if err := surfstore.ClientSync(c.RPCClient); err != nil {
+		c.t.Fatalf("sync of %v failed: %v", c.BaseDir, err)
+	}
+}
+
+// WriteFile creates or replaces a file in the base dir. The contents are
+// written to a new file that is renamed over the old one, so the change is
+// seen even within the file system's mtime resolution.
+func (c *Client) WriteFile(name string, contents string) {
+	c.t.Helper()
+	f, err := os.CreateTemp(c.BaseDir, ".write-*")
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		c.t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(c.BaseDir, name)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// RemoveFile deletes a file from the base dir
+func (c *Client) RemoveFile(name string) {
+	c.t.Helper()
+	if err := os.Remove(filepath.Join(c.BaseDir, name)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Files returns the contents of every file in the base dir by name, leaving
+// out the client's index and cursor files and subdirectories
+func (c *Client) Files() map[string]string {
+	c.t.Helper()
+	entries, err := os.ReadDir(c.BaseDir)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		switch entry.Name() {
+		case surfstore.DEFAULT_META_FILENAME, surfstore.DEFAULT_CURSOR_FILENAME:
+			continue
+		}
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(c.BaseDir, entry.Name()))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+// Index returns the entries of the client's index.txt
+func (c *Client) Index() map[string]*surfstore.FileMetaData {
+	c.t.Helper()
+	index, _, err := surfstore.LoadLocalIndex(c.BaseDir)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return index
+}
+
+// ServerFiles returns the MetaStore's entries of files that are not deleted
+func (c *Cluster) ServerFiles() map[string]*surfstore.FileMetaData {
+	c.t.Helper()
+	fileInfoMap, err := c.MetaStore.GetFileInfoMap(context.Background(), &emptypb.Empty{})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	files := make(map[string]*surfstore.FileMetaData)
+	for filename, fmd := range fileInfoMap.GetFileInfoMap() {
+		if !fmd.GetDeleted() {
+			files[filename] = fmd
+		}
+	}
+	return files
+}
+
+// SyncAll syncs the clients one after another
+func SyncAll(clients ...*Client) {
+	for _, client := range clients {
+		client.Sync()
+	}
+}
+
+// Converge syncs the clients twice, which brings every client the changes
+// of the others, and asserts that they converged
+func (c *Cluster) Converge(clients ...*Client) {
+	c.t.Helper()
+	SyncAll(clients...)
+	SyncAll(clients...)
+	c.AssertConverged(clients...)
+}
+
+// AssertConverged fails the test unless every client holds the same files as
+// the first one, the MetaStore lists exactly those files, and every client's
+// index records the MetaStore's version and blocks of each file
+func (c *Cluster) AssertConverged(clients ...*Client) {
+	c.t.Helper()
+	if len(clients) == 0 {
+		return
+	}
+	want := clients[0].Files()
+	for i, client := range clients[1:] {
+		if got := client.Files(); !sameFiles(got, want) {
+			c.t.Errorf("client %v holds %v, client 0 holds %v", i+1, describe(got), describe(want))
+		}
+	}
+
+	serverFiles := c.ServerFiles()
+	if len(serverFiles) != len(want) {
+		c.t.Errorf("server lists %v files, clients hold %v", len(serverFiles), describe(want))
+	}
+	for i, client := range clients {
+		index := client.Index()
+		for filename, serverMD := range serverFiles {
+			localMD, ok := index[filename]
+			if !ok {
+				c.t.Errorf("client %v has no index entry for %v", i, filename)
+				continue
+			}
+			if localMD.GetVersion() != serverMD.GetVersion() {
+				c.t.Errorf("client %v indexes %v at version %v, server holds version %v", i, filename, localMD.GetVersion(), serverMD.GetVersion())
+			}
+			if surfstore.GetHashString(localMD.GetBlockHashList()) != surfstore.GetHashString(serverMD.GetBlockHashList()) {
+				c.t.Errorf("client %v indexes other blocks for %v than the server", i, filename)
+			}
+		}
+	}
+}
+
+func sameFiles(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, contents := range a {
+		if other, ok := b[name]; !ok || other != contents {
+			return false
+		}
+	}
+	return true
+}
+
+// describe lists file names and contents in name order for failure messages
+func describe(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := "{"
+	for i, name := range names {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%v: %q", name, files[name])
+	}
+	return s + "}"
+}
@@ -0,0 +1,641 @@
+package surfstoretest
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMain silences the client's and the stores' debug logging unless the
+// tests run with -v
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+func TestCreate(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(3)
+	clients[0].WriteFile("small.txt", "hello")
+	clients[0].WriteFile("large.txt", strings.Repeat("spans several blocks ", 20))
+	clients[1].WriteFile("other.txt", "from the second client")
+
+	cluster.Converge(clients...)
+	if got := clients[2].Files()["large.txt"]; got != strings.Repeat("spans several blocks ", 20) {
+		t.Errorf("large.txt = %q", got)
+	}
+	if n := len(cluster.ServerFiles()); n != 3 {
+		t.Errorf("server lists %v files, want 3", n)
+	}
+}
+
+func TestModify(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("notes.txt", "first draft")
+	cluster.Converge(clients...)
+
+	clients[1].WriteFile("notes.txt", "second draft, somewhat longer than the first")
+	cluster.Converge(clients...)
+	if got := clients[0].Files()["notes.txt"]; got != "second draft, somewhat longer than the first" {
+		t.Errorf("notes.txt = %q", got)
+	}
+	if v := cluster.ServerFiles()["notes.txt"].GetVersion(); v != 2 {
+		t.Errorf("version = %v, want 2", v)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("keep.txt", "kept")
+	clients[0].WriteFile("drop.txt", "dropped")
+	cluster.Converge(clients...)
+
+	clients[1].RemoveFile("drop.txt")
+	cluster.Converge(clients...)
+	if _, ok := clients[0].Files()["drop.txt"]; ok {
+		t.Error("drop.txt was not deleted")
+	}
+	if !clients[0].Index()["drop.txt"].GetDeleted() {
+		t.Error("drop.txt has no tombstone in the index")
+	}
+
+	// a deleted file can be created again
+	clients[0].WriteFile("drop.txt", "back again")
+	cluster.Converge(clients...)
+	if got := clients[1].Files()["drop.txt"]; got != "back again" {
+		t.Errorf("drop.txt = %q", got)
+	}
+}
+
+func TestConflictingModify(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("shared.txt", "original")
+	cluster.Converge(clients...)
+
+	// the first client to sync wins, the other one gets its version
+	clients[0].WriteFile("shared.txt", "edited by client 0")
+	clients[1].WriteFile("shared.txt", "edited by client 1")
+	SyncAll(clients[0], clients[1])
+	cluster.Converge(clients...)
+	if got := clients[1].Files()["shared.txt"]; got != "edited by client 0" {
+		t.Errorf("shared.txt = %q, want the first synced edit", got)
+	}
+}
+
+func TestConflictingCreate(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[1].WriteFile("new.txt", "created by client 1")
+	clients[0].WriteFile("new.txt", "created by client 0")
+
+	SyncAll(clients[1], clients[0])
+	cluster.Converge(clients...)
+	if got := clients[0].Files()["new.txt"]; got != "created by client 1" {
+		t.Errorf("new.txt = %q, want the first synced creation", got)
+	}
+}
+
+func TestConflictingDelete(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("doomed.txt", "original")
+	cluster.Converge(clients...)
+
+	// an edit wins over a deletion that synced first, so no contents are lost
+	clients[0].RemoveFile("doomed.txt")
+	clients[1].WriteFile("doomed.txt", "edited while deleted elsewhere")
+	SyncAll(clients[0], clients[1])
+	cluster.Converge(clients...)
+	if got := clients[0].Files()["doomed.txt"]; got != "edited while deleted elsewhere" {
+		t.Errorf("doomed.txt = %q, want the edit", got)
+	}
+}
+
+func TestCreateOverTombstone(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("reused.txt", "original")
+	cluster.Converge(clients...)
+	clients[0].RemoveFile("reused.txt")
+	cluster.Converge(clients...)
+
+	// a client that never saw the file creates it again under the old name
+	fresh := cluster.NewClient()
+	fresh.WriteFile("reused.txt", "new contents")
+	fresh.Sync()
+	if got := fresh.Files()["reused.txt"]; got != "new contents" {
+		t.Fatalf("reused.txt = %q, the new file was lost", got)
+	}
+	cluster.Converge(append(clients, fresh)...)
+	if got := clients[0].Files()["reused.txt"]; got != "new contents" {
+		t.Errorf("reused.txt = %q", got)
+	}
+}
+
+func TestExpiredTombstone(t *testing.T) {
+	cluster := NewCluster(t)
+	cluster.MetaStore.TombstoneRetention = 1
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("a.txt", "deleted while client 1 is away")
+	clients[0].WriteFile("b.txt", "kept")
+	cluster.Converge(clients...)
+
+	// the tombstone expires before client 1 syncs again
+	clients[0].RemoveFile("a.txt")
+	clients[0].Sync()
+	clients[1].Sync()
+	if _, ok := clients[1].Files()["a.txt"]; ok {
+		t.Error("a.txt was not deleted on client 1")
+	}
+	if _, ok := cluster.ServerFiles()["a.txt"]; ok {
+		t.Error("a.txt was uploaded again")
+	}
+	cluster.Converge(clients...)
+}
+
+// dirContents returns the contents of every file in a directory by name,
+// index files included
+func dirContents(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[entry.Name()] = string(data)
+	}
+	return contents
+}
+
+// TestDryRun checks that a dry run leaves the base dir, the index and the
+// servers as they were
+func TestDryRun(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(3)
+	clients[0].WriteFile("modified.txt", "first version")
+	clients[0].WriteFile("deleted.txt", "deleted locally")
+	clients[0].WriteFile("moved.txt", "renamed locally")
+	cluster.Converge(clients[:2]...)
+
+	clients[0].WriteFile("modified.txt", "second version")
+	clients[0].RemoveFile("deleted.txt")
+	clients[0].WriteFile("new.txt", "not uploaded yet")
+	if err := os.Rename(filepath.Join(clients[0].BaseDir, "moved.txt"), filepath.Join(clients[0].BaseDir, "renamed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	clients[1].WriteFile("remote.txt", "not downloaded yet")
+	clients[1].Sync()
+
+	before, err := cluster.MetaStore.GetChangesSince(context.Background(), &surfstore.ChangeCursor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := len(cluster.BlockStore.BlockMap)
+	for _, client := range []*Client{clients[0], clients[2]} {
+		files := dirContents(t, client.BaseDir)
+		client.DryRun = true
+		client.Sync()
+		if after := dirContents(t, client.BaseDir); !sameFiles(files, after) {
+			t.Errorf("dry run changed the base dir from %v to %v", describe(files), describe(after))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(clients[2].BaseDir, surfstore.DEFAULT_META_FILENAME)); err == nil {
+		t.Error("dry run created index.txt")
+	}
+	after, err := cluster.MetaStore.GetChangesSince(context.Background(), &surfstore.ChangeCursor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.GetCursor() != before.GetCursor() {
+		t.Error("dry run committed to the MetaStore")
+	}
+	if n := len(cluster.BlockStore.BlockMap); n != blocks {
+		t.Errorf("dry run stored %v blocks", n-blocks)
+	}
+
+	clients[0].DryRun = false
+	clients[2].DryRun = false
+	cluster.Converge(clients...)
+	if _, ok := clients[2].Files()["renamed.txt"]; !ok {
+		t.Error("renamed.txt was not synced after the dry run")
+	}
+}
+
+// TestFailedDownload checks that a download that can't fetch its blocks
+// leaves the local file as it was
+func TestFailedDownload(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("a.txt", "the version both clients have")
+	cluster.Converge(clients...)
+
+	clients[0].WriteFile("a.txt", "a version client 1 can't download")
+	clients[0].Sync()
+	cluster.StopBlockStore(BLOCKSTORE_ADDR)
+	if err := surfstore.ClientSync(clients[1].RPCClient); err == nil {
+		t.Fatal("sync succeeded without a BlockStore")
+	}
+	files := clients[1].Files()
+	if got := files["a.txt"]; got != "the version both clients have" {
+		t.Errorf("a.txt = %q after the failed download", got)
+	}
+	if len(files) != 1 {
+		t.Errorf("base dir holds %v", describe(files))
+	}
+
+	cluster.ServeBlockStore(BLOCKSTORE_ADDR, cluster.BlockStore)
+	cluster.Converge(clients...)
+}
+
+func TestIgnoredAndSubdirectories(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].IgnorePatterns = []string{"*.tmp", "cache/"}
+	clients[0].WriteFile(surfstore.DEFAULT_IGNORE_FILENAME, "!keep.tmp\n")
+	clients[0].WriteFile("scratch.tmp", "ignored by the global patterns")
+	clients[0].WriteFile("keep.tmp", "synced, the ignore file wins")
+	clients[0].WriteFile("notes.txt", "synced")
+	// subdirectories are left alone, whether or not a pattern ignores them
+	for _, dir := range []string{".git", "cache", "sub"} {
+		if err := os.Mkdir(filepath.Join(clients[0].BaseDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(clients[0].BaseDir, dir, "inner.txt"), []byte("nested"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SyncAll(clients...)
+	SyncAll(clients...)
+	files := cluster.ServerFiles()
+	for _, name := range []string{surfstore.DEFAULT_IGNORE_FILENAME, "keep.tmp", "notes.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%v was not synced", name)
+		}
+	}
+	for _, name := range []string{"scratch.tmp", ".git", "cache", "sub"} {
+		if _, ok := files[name]; ok {
+			t.Errorf("%v was synced", name)
+		}
+	}
+	if got := clients[1].Files()["keep.tmp"]; got != "synced, the ignore file wins" {
+		t.Errorf("keep.tmp = %q", got)
+	}
+}
+
+func TestBlockSizeChange(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("data.txt", strings.Repeat("x", 4*DEFAULT_BLOCK_SIZE))
+	cluster.Converge(clients...)
+
+	// unchanged files are hashed again at the new block size
+	clients[0].BlockSize = DEFAULT_BLOCK_SIZE / 2
+	cluster.Converge(clients...)
+	if n := len(cluster.ServerFiles()["data.txt"].GetBlockHashList()); n != 8 {
+		t.Errorf("data.txt has %v blocks, want 8", n)
+	}
+}
+
+func TestQuotaChecksSize(t *testing.T) {
+	cluster := NewCluster(t)
+	cluster.MetaStore.QuotaBytes = 1000
+	client := cluster.NewClient()
+	client.WriteFile("data.txt", strings.Repeat("x", 3*DEFAULT_BLOCK_SIZE))
+	client.Sync()
+	if size := cluster.ServerFiles()["data.txt"].GetSize(); size != int64(3*DEFAULT_BLOCK_SIZE) {
+		t.Fatalf("data.txt has size %v, want %v", size, 3*DEFAULT_BLOCK_SIZE)
+	}
+
+	// a client cannot report a smaller size than its blocks add up to
+	fileMetaData := cluster.ServerFiles()["data.txt"]
+	fileMetaData.Version++
+	fileMetaData.Size = 1
+	var version int32
+	err := client.UpdateFile(&surfstore.FileUpdate{FileMetaData: fileMetaData, ExpectedVersion: fileMetaData.GetVersion() - 1}, &version)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("update with a wrong size returned %v, want InvalidArgument", err)
+	}
+
+	fileMetaData.Size = int64(3 * DEFAULT_BLOCK_SIZE)
+	fileMetaData.BlockHashList = append(fileMetaData.BlockHashList, surfstore.GetBlockHashString([]byte("never uploaded")))
+	err = client.UpdateFile(&surfstore.FileUpdate{FileMetaData: fileMetaData, ExpectedVersion: fileMetaData.GetVersion() - 1}, &version)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("update with a missing block returned %v, want FailedPrecondition", err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	clients[0].WriteFile("data.txt", strings.Repeat("0123456789abcdef", 32))
+	cluster.Converge(clients[0])
+
+	// a second BlockStore joins, the blocks it now owns move to it
+	joined := cluster.AddBlockStore("blockstore2")
+	from := []string{BLOCKSTORE_ADDR}
+	to := []string{BLOCKSTORE_ADDR, "blockstore2"}
+	cluster.MetaStore.BlockStoreAddrs = to
+	cluster.MetaStore.PreviousBlockStoreAddrs = from
+	cluster.BlockStore.AdminToken = "secret"
+	rebalancer := &surfstore.Rebalancer{From: from, To: to, ReplicationFactor: 1, DialOptions: cluster.DialOptions(), AdminToken: "secret"}
+	select {
+	case <-cluster.MetaStore.StartRebalancing(context.Background(), time.Millisecond, rebalancer):
+	case <-time.After(10 * time.Second):
+		t.Fatal("rebalancing did not complete")
+	}
+	if previous := cluster.MetaStore.PreviousBlockStoreAddrs; len(previous) != 0 {
+		t.Errorf("previous BlockStores %v were not cleared", previous)
+	}
+
+	stores := map[string]*surfstore.BlockStore{BLOCKSTORE_ADDR: cluster.BlockStore, "blockstore2": joined}
+	moved := 0
+	for _, hash := range cluster.ServerFiles()["data.txt"].GetBlockHashList() {
+		owner := surfstore.BlockOwners(hash, to)[0]
+		for addr, store := range stores {
+			held, err := store.HasBlocks(context.Background(), &surfstore.BlockHashes{Hashes: []string{hash}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has := len(held.GetHashes()) == 1; has != (addr == owner) {
+				t.Errorf("%v holds block %v: %v, its owner is %v", addr, hash, has, owner)
+			}
+		}
+		if owner == "blockstore2" {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no block moved to the new BlockStore")
+	}
+
+	// clients read the blocks from their new owners
+	cluster.Converge(clients...)
+}
+
+// serveErasureCoded serves a BlockStore at addr that erasure codes blocks
+// across addrs and keeps its blocks and shards in dir, replacing the server
+// at addr if there is one
+func serveErasureCoded(cluster *Cluster, addr string, addrs []string, dir string, k, m int) {
+	storage, err := surfstore.NewDiskBlockStorage(dir)
+	if err != nil {
+		cluster.t.Fatal(err)
+	}
+	blockStore := surfstore.NewBlockStore()
+	blockStore.Storage = storage
+	blockStore.Self = addr
+	blockStore.Peers = addrs
+	blockStore.DataShards = k
+	blockStore.ParityShards = m
+	blockStore.DialOptions = cluster.DialOptions()
+	cluster.StopBlockStore(addr)
+	cluster.ServeBlockStore(addr, blockStore)
+}
+
+func TestErasureCodedRestart(t *testing.T) {
+	const k, m = 2, 2
+	cluster := NewCluster(t)
+	addrs := []string{BLOCKSTORE_ADDR, "blockstore1", "blockstore2", "blockstore3"}
+	dirs := make(map[string]string)
+	for _, addr := range addrs {
+		dirs[addr] = t.TempDir()
+		serveErasureCoded(cluster, addr, addrs, dirs[addr], k, m)
+	}
+	cluster.MetaStore.BlockStoreAddrs = addrs
+
+	contents := strings.Repeat("erasure coded across four BlockStores ", 8)
+	writer := cluster.NewClient()
+	writer.WriteFile("data.txt", contents)
+	writer.Sync()
+
+	// every BlockStore restarts, the shards are read back from disk
+	for _, addr := range addrs {
+		serveErasureCoded(cluster, addr, addrs, dirs[addr], k, m)
+	}
+
+	// any m BlockStores may be down
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			cluster.StopBlockStore(addrs[i])
+			cluster.StopBlockStore(addrs[j])
+			reader := cluster.NewClient()
+			reader.Sync()
+			if got := reader.Files()["data.txt"]; got != contents {
+				t.Errorf("with %v and %v down data.txt = %q", addrs[i], addrs[j], got)
+			}
+			serveErasureCoded(cluster, addrs[i], addrs, dirs[addrs[i]], k, m)
+			serveErasureCoded(cluster, addrs[j], addrs, dirs[addrs[j]], k, m)
+		}
+	}
+}
+
+// serveReplicated serves a BlockStore at addr that keeps r copies of each
+// block across addrs, replacing the server at addr if there is one
+func serveReplicated(cluster *Cluster, addr string, addrs []string, r int) *surfstore.BlockStore {
+	blockStore := surfstore.NewBlockStore()
+	blockStore.Self = addr
+	blockStore.Peers = addrs
+	blockStore.ReplicationFactor = r
+	blockStore.DialOptions = cluster.DialOptions()
+	cluster.StopBlockStore(addr)
+	cluster.ServeBlockStore(addr, blockStore)
+	return blockStore
+}
+
+// holds reports whether a BlockStore holds a block
+func holds(t *testing.T, blockStore *surfstore.BlockStore, hash string) bool {
+	t.Helper()
+	held, err := blockStore.HasBlocks(context.Background(), &surfstore.BlockHashes{Hashes: []string{hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(held.GetHashes()) == 1
+}
+
+// TestQuorumWrites checks that blocks are stored while a quorum of their
+// owners is up, and that a sync fails without one
+func TestQuorumWrites(t *testing.T) {
+	cluster := NewCluster(t)
+	addrs := []string{BLOCKSTORE_ADDR, "blockstore1", "blockstore2"}
+	stores := make(map[string]*surfstore.BlockStore)
+	for _, addr := range addrs {
+		stores[addr] = serveReplicated(cluster, addr, addrs, 3)
+	}
+	cluster.MetaStore.BlockStoreAddrs = addrs
+
+	// two of the three owners make a quorum
+	cluster.StopBlockStore("blockstore2")
+	client := cluster.NewClient()
+	client.WriteFile("data.txt", strings.Repeat("replicated to a quorum ", 8))
+	client.Sync()
+	for _, hash := range cluster.ServerFiles()["data.txt"].GetBlockHashList() {
+		for _, addr := range addrs[:2] {
+			if !holds(t, stores[addr], hash) {
+				t.Errorf("%v does not hold block %v", addr, hash)
+			}
+		}
+	}
+
+	cluster.StopBlockStore("blockstore1")
+	client.WriteFile("lost.txt", "no quorum for these blocks")
+	if err := surfstore.ClientSync(client.RPCClient); err == nil {
+		t.Error("sync succeeded with one of three BlockStores up")
+	}
+	if _, ok := cluster.ServerFiles()["lost.txt"]; ok {
+		t.Error("lost.txt was committed without a quorum of its blocks")
+	}
+}
+
+// TestReadsWithOwnerDown checks that clients read blocks from their other
+// owner while one BlockStore is stopped
+func TestReadsWithOwnerDown(t *testing.T) {
+	cluster := NewCluster(t)
+	addrs := []string{BLOCKSTORE_ADDR, "blockstore1", "blockstore2"}
+	stores := make(map[string]*surfstore.BlockStore)
+	for _, addr := range addrs {
+		stores[addr] = serveReplicated(cluster, addr, addrs, 2)
+	}
+	cluster.MetaStore.BlockStoreAddrs = addrs
+
+	contents := strings.Repeat("two copies of every block ", 8)
+	writer := cluster.NewClient()
+	writer.WriteFile("data.txt", contents)
+	writer.Sync()
+
+	for _, addr := range addrs {
+		cluster.StopBlockStore(addr)
+		reader := cluster.NewClient()
+		reader.Sync()
+		if got := reader.Files()["data.txt"]; got != contents {
+			t.Errorf("with %v down data.txt = %q", addr, got)
+		}
+		cluster.ServeBlockStore(addr, stores[addr])
+	}
+}
+
+// TestBlockOwnersAfterJoin checks that a joining BlockStore only takes over
+// blocks from the others, and that the blocks stay readable before they are
+// rebalanced while one of their owners is stopped
+func TestBlockOwnersAfterJoin(t *testing.T) {
+	cluster := NewCluster(t)
+	addrs := []string{BLOCKSTORE_ADDR, "blockstore1", "blockstore2"}
+	for _, addr := range addrs {
+		serveReplicated(cluster, addr, addrs, 2)
+	}
+	cluster.MetaStore.BlockStoreAddrs = addrs
+
+	contents := strings.Repeat("written before the fourth BlockStore joined ", 8)
+	writer := cluster.NewClient()
+	writer.WriteFile("data.txt", contents)
+	writer.Sync()
+
+	// the ranking of the other BlockStores is unchanged, so a block only
+	// moves if the new BlockStore ranks among its owners
+	joined := append(append([]string(nil), addrs...), "blockstore3")
+	hashes := cluster.ServerFiles()["data.txt"].GetBlockHashList()
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, surfstore.GetBlockHashString([]byte(fmt.Sprint(i))))
+	}
+	moved := 0
+	for _, hash := range hashes {
+		before := surfstore.BlockOwners(hash, addrs)
+		after := make([]string, 0, len(addrs))
+		for _, addr := range surfstore.BlockOwners(hash, joined) {
+			if addr != "blockstore3" {
+				after = append(after, addr)
+			}
+		}
+		if strings.Join(after, ",") != strings.Join(before, ",") {
+			t.Fatalf("block %v was ranked %v, and %v after the join", hash, before, after)
+		}
+		if owners := surfstore.BlockOwners(hash, joined)[:2]; owners[0] == "blockstore3" || owners[1] == "blockstore3" {
+			moved++
+		}
+	}
+	// two of four owners are the new one for about half of the blocks
+	if moved < len(hashes)/3 || moved > 2*len(hashes)/3 {
+		t.Errorf("%v of %v blocks moved to the new BlockStore", moved, len(hashes))
+	}
+
+	serveReplicated(cluster, "blockstore3", joined, 2)
+	cluster.MetaStore.BlockStoreAddrs = joined
+	cluster.MetaStore.PreviousBlockStoreAddrs = addrs
+	cluster.StopBlockStore(BLOCKSTORE_ADDR)
+	reader := cluster.NewClient()
+	reader.Sync()
+	if got := reader.Files()["data.txt"]; got != contents {
+		t.Errorf("data.txt = %q before rebalancing", got)
+	}
+}
+
+// TestRename checks that a renamed file reaches other clients as a rename:
+// the server moves its entry, and no blocks are uploaded or downloaded
+func TestRename(t *testing.T) {
+	cluster := NewCluster(t)
+	clients := cluster.NewClients(2)
+	contents := strings.Repeat("renamed rather than copied ", 8)
+	clients[0].WriteFile("old.txt", contents)
+	cluster.Converge(clients...)
+	before, err := os.Stat(filepath.Join(clients[1].BaseDir, "old.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	puts, gets := cluster.Calls("PutBlock"), cluster.Calls("GetBlock")
+	if err := os.Rename(filepath.Join(clients[0].BaseDir, "old.txt"), filepath.Join(clients[0].BaseDir, "new.txt")); err != nil {
+		t.Fatal(err)
+	}
+	cluster.Converge(clients...)
+	if n := cluster.Calls("RenameFile"); n != 1 {
+		t.Errorf("RenameFile was called %v times, want once", n)
+	}
+	if n := cluster.Calls("PutBlock") - puts; n != 0 {
+		t.Errorf("the rename uploaded %v blocks", n)
+	}
+	if n := cluster.Calls("GetBlock") - gets; n != 0 {
+		t.Errorf("the rename downloaded %v blocks", n)
+	}
+
+	files := cluster.ServerFiles()
+	if _, ok := files["old.txt"]; ok {
+		t.Error("old.txt is still on the server")
+	}
+	// the moved entry continues the version history of old.txt
+	if v := files["new.txt"].GetVersion(); v != 2 {
+		t.Errorf("new.txt has version %v, want 2", v)
+	}
+
+	// the other client renamed its copy instead of writing a new file
+	after, err := os.Stat(filepath.Join(clients[1].BaseDir, "new.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("new.txt on client 1 is a new file, not the renamed old.txt")
+	}
+	if _, ok := clients[1].Files()["old.txt"]; ok {
+		t.Error("old.txt is still on client 1")
+	}
+}